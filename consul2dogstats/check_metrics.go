@@ -0,0 +1,83 @@
+package consul2dogstats
+
+import (
+	consul "github.com/hashicorp/consul/api"
+)
+
+// checkCounts holds the number of checks in each status which have a
+// particular set of tags.
+type checkCounts struct {
+	tags          tagSet
+	countByStatus map[string]uint
+}
+
+// checkMetrics counts the individual health checks of each service instance,
+// and, if nodeChecks is true, of the nodes they run on, by check and status.
+// A node check appears in the health of every service instance on its node,
+// but is only counted once.  Maintenance mode checks are counted as
+// "maintenance" rather than "critical".
+func checkMetrics(datacenter string, health map[string][]*consul.ServiceEntry, nodeChecks bool) []Metric {
+	metricName := "consul.check.count"
+
+	// The map is keyed by the check's tag set (other than its status), and
+	// holds the number of checks with those tags in each status.
+	countByTags := make(map[string]*checkCounts)
+	seenNodeChecks := make(map[string]bool)
+
+	for _, serviceHealth := range health {
+		for _, entry := range serviceHealth {
+			for _, check := range entry.Checks {
+				node := check.Node
+				if node == "" && entry.Node != nil {
+					node = entry.Node.Node
+				}
+				if isNodeCheck(check) {
+					// node check, shared by every instance on the node
+					if !nodeChecks || seenNodeChecks[node+"/"+check.CheckID] {
+						continue
+					}
+					seenNodeChecks[node+"/"+check.CheckID] = true
+				}
+
+				var tags []string
+				for _, tag := range [][2]string{
+					{"check_id", check.CheckID},
+					{"check_name", check.Name},
+					{"check_type", check.Type},
+					{"service", check.ServiceName},
+					{"node", node},
+				} {
+					if tag[1] != "" {
+						tags = append(tags, tag[0]+":"+tag[1])
+					}
+				}
+				set := newTagSet(tags)
+
+				counts := countByTags[set.key()]
+				if counts == nil {
+					counts = &checkCounts{tags: set, countByStatus: make(map[string]uint)}
+					for _, status := range []string{"critical", "warning", "passing"} {
+						counts.countByStatus[status] = 0
+					}
+					countByTags[set.key()] = counts
+				}
+				status := check.Status
+				if isMaintenanceCheck(check) {
+					status = "maintenance"
+				}
+				counts.countByStatus[status]++
+			}
+		}
+	}
+
+	var metrics []Metric
+	for _, counts := range countByTags {
+		for checkStatus, count := range counts.countByStatus {
+			tags := counts.tags.with(
+				"status:"+checkStatus,
+				"datacenter:"+datacenter)
+			metrics = append(metrics, newMetric(metricName, float64(count), tags))
+		}
+	}
+	return metrics
+}
@@ -0,0 +1,89 @@
+package consul2dogstats
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// testClock is a clock whose ticks are delivered by the test, so that tests
+// control exactly when collections happen.  Timers created by After fire
+// once the clock has been advanced past them.
+type testClock struct {
+	mtx    sync.Mutex
+	now    time.Time
+	tickCh chan time.Time
+	timers []testTimer
+}
+
+type testTimer struct {
+	at time.Time
+	ch chan time.Time
+}
+
+type testTicker struct {
+	ch chan time.Time
+}
+
+func (t testTicker) Chan() <-chan time.Time { return t.ch }
+func (t testTicker) Stop()                  {}
+
+func newTestClock() *testClock {
+	return &testClock{
+		now:    time.Unix(1500000000, 0),
+		tickCh: make(chan time.Time),
+	}
+}
+
+func (c *testClock) Now() time.Time {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.now
+}
+
+// NewTicker returns a ticker which only ticks when tick is called.
+func (c *testClock) NewTicker(time.Duration) ticker {
+	return testTicker{c.tickCh}
+}
+
+func (c *testClock) After(d time.Duration) <-chan time.Time {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	timer := testTimer{at: c.now.Add(d), ch: make(chan time.Time, 1)}
+	c.timers = append(c.timers, timer)
+	c.fire()
+	return timer.ch
+}
+
+// advance moves the clock forward by d, firing any timers that are due.
+func (c *testClock) advance(d time.Duration) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.now = c.now.Add(d)
+	c.fire()
+}
+
+// fire fires the timers that are due.  The caller must hold c.mtx.
+func (c *testClock) fire() {
+	pending := c.timers[:0]
+	for _, timer := range c.timers {
+		if timer.at.After(c.now) {
+			pending = append(pending, timer)
+			continue
+		}
+		timer.ch <- c.now
+	}
+	c.timers = pending
+}
+
+// tick advances the clock by d and delivers a tick, waiting until the
+// collector is ready to receive it, which is once it has finished with the
+// previous one.
+func (c *testClock) tick(t *testing.T, d time.Duration) {
+	c.advance(d)
+	select {
+	case c.tickCh <- c.Now():
+	case <-time.After(5 * time.Second):
+		t.Fatal("collector not waiting for a tick")
+	}
+}
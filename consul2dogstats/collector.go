@@ -1,187 +1,843 @@
 package consul2dogstats
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
 	"os"
-	"os/signal"
 	"sort"
 	"strings"
-	"syscall"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 	consul "github.com/hashicorp/consul/api"
-	"github.com/zorkian/go-datadog-api"
 )
 
 type Collector struct {
-	datadogClient       datadogClient
-	collectInterval     time.Duration
-	lockKey             string
-	lock                consulLock
-	healthServiceFunc   func(service, tag string, passingOnly bool, q *consul.QueryOptions) ([]*consul.ServiceEntry, *consul.QueryMeta, error)
-	catalogServicesFunc func(q *consul.QueryOptions) (map[string][]string, *consul.QueryMeta, error)
-	agentSelfFunc       func() (map[string]map[string]interface{}, error)
+	sink                   Sink
+	collectInterval        time.Duration
+	lockKey                string
+	newLock                func(key string) (leaderLock, error)
+	healthServiceFunc      func(service, tag string, passingOnly bool, q *consul.QueryOptions) ([]*consul.ServiceEntry, *consul.QueryMeta, error)
+	catalogServicesFunc    func(q *consul.QueryOptions) (map[string][]string, *consul.QueryMeta, error)
+	catalogServiceFunc     func(service, tag string, q *consul.QueryOptions) ([]*consul.CatalogService, *consul.QueryMeta, error)
+	catalogNodesFunc       func(q *consul.QueryOptions) ([]*consul.Node, *consul.QueryMeta, error)
+	healthStateFunc        func(state string, q *consul.QueryOptions) (consul.HealthChecks, *consul.QueryMeta, error)
+	agentSelfFunc          func() (map[string]map[string]interface{}, error)
+	catalogDatacentersFunc func() ([]string, error)
+	kvGetFunc              func(key string, q *consul.QueryOptions) (*consul.KVPair, *consul.QueryMeta, error)
+	kvListFunc             func(prefix string, q *consul.QueryOptions) (consul.KVPairs, *consul.QueryMeta, error)
+	sessionInfoFunc        func(id string, q *consul.QueryOptions) (*consul.SessionEntry, *consul.QueryMeta, error)
+
+	// Datacenters lists the datacenters to collect from.  If it includes
+	// AllDatacenters, every datacenter known to Consul is collected from.  If
+	// empty, only the local agent's datacenter is collected from.
+	Datacenters []string
+
+	// LockMode selects whether a single lock covers every datacenter, or
+	// each datacenter has a lock of its own.
+	LockMode LockMode
+
+	// Fencing selects what happens to metrics collected under a Consul lock
+	// when, before they're posted, the lock can't be verified to still be
+	// held by the session that acquired it.
+	Fencing FencingMode
+
+	// MaxTicks is the number of collections after which Run releases the
+	// lock and returns, retries included.  Zero means no limit, in which
+	// case Run only returns once its context is done or it gives up.
+	MaxTicks int
+
+	// Retry controls how failed collections are retried, and how many
+	// consecutive failures are tolerated before the collector gives up.
+	Retry RetryPolicy
+
+	// Strategy selects how service health is fetched when polling.
+	Strategy HealthStrategy
+
+	// Concurrency is the maximum number of concurrent requests made for the
+	// health of individual services.
+	Concurrency int
+
+	// RequestTimeout is how long to wait for each request to Consul made
+	// while polling before failing the collection.  Zero means no timeout.
+	RequestTimeout time.Duration
+
+	// Watch enables watch mode, in which service health is tracked using
+	// Consul blocking queries and metrics are published as soon as it
+	// changes, in addition to on every collection interval.  Watches are
+	// always made per service, regardless of Strategy.  Watch mode
+	// isn't supported in sharded lock mode.
+	Watch bool
+
+	// CheckMetrics enables the consul.check.count metric, which counts
+	// individual health checks by check, service, node and status, alongside
+	// the per-service rollup.
+	CheckMetrics bool
+
+	// NodeMetrics enables the consul.node.count metric, which counts the
+	// nodes in the catalog by status and by the metadata listed in
+	// NodeMetaTags.  Nodes are always polled, even in watch mode.
+	NodeMetrics bool
+
+	// ExcludeNodeChecks leaves checks of the node a service instance runs
+	// on, such as serfHealth, out of the instance's status, so that only
+	// the service's own checks count.  Node maintenance mode is still
+	// recognised.
+	ExcludeNodeChecks bool
+
+	// MaintenanceReasonTag tags the counts of instances in maintenance mode
+	// with the reason given when maintenance was enabled.
+	MaintenanceReasonTag bool
+
+	// ServiceFilter selects which services in the catalog are collected.
+	// If nil, every service is.
+	ServiceFilter *Filter
+
+	// TagFilter selects which Consul service tags are forwarded as Datadog
+	// tags.  If nil, every tag is.
+	TagFilter *Filter
+
+	// TagRewriter rewrites the Consul service tags that pass TagFilter into
+	// Datadog tags.  If nil, they're forwarded unchanged.
+	TagRewriter *TagRewriter
+
+	// ServiceMetaTags and NodeMetaTags list the keys of service and node
+	// metadata to forward as key:value tags.
+	ServiceMetaTags []string
+	NodeMetaTags    []string
+
+	election      LeaderElection
+	shard         *shardMembers
+	watchCoalesce time.Duration
+	datacenter    string
+	rand          *rand.Rand
+	clock         clock
+	stats         selfStats
+	instances     instanceCache
+	status        tickStatus
 }
 
-func NewCollector(datadogClient datadogClient,
+// NewCollector returns a Collector that publishes the health of the
+// services registered with consulClient to sink, as configured by cfg.
+func NewCollector(sink Sink,
 	consulClient *consul.Client,
-	lockKey string,
-	collectInterval time.Duration) (*Collector, error) {
+	cfg *Config) (*Collector, error) {
 
 	var err error
 
 	c := new(Collector)
 	c.healthServiceFunc = consulClient.Health().Service
 	c.catalogServicesFunc = consulClient.Catalog().Services
+	c.catalogServiceFunc = consulClient.Catalog().Service
+	c.catalogNodesFunc = consulClient.Catalog().Nodes
+	c.healthStateFunc = consulClient.Health().State
 	c.agentSelfFunc = consulClient.Agent().Self
-
-	c.lock, err = consulClient.LockKey(lockKey)
-	if err != nil {
+	c.catalogDatacentersFunc = consulClient.Catalog().Datacenters
+	c.kvGetFunc = consulClient.KV().Get
+	c.kvListFunc = consulClient.KV().List
+	c.sessionInfoFunc = consulClient.Session().Info
+	if c.newLock, err = newLocker(consulClient, cfg); err != nil {
+		return nil, err
+	}
+	// Fail early on invalid lock options.
+	if _, err = c.newLock(cfg.LockPath); err != nil {
 		return nil, err
 	}
+	c.election = cfg.LeaderElection
 
-	c.collectInterval = collectInterval
-	c.lockKey = lockKey
-	c.datadogClient = datadogClient
+	c.collectInterval = cfg.CollectInterval
+	c.lockKey = cfg.LockPath
+	c.sink = sink
+	c.Datacenters = cfg.Datacenters
+	c.LockMode = cfg.LockMode
+	c.Fencing = cfg.Fencing
+	c.Retry = RetryPolicy{
+		InitialBackoff: cfg.RetryInitialBackoff,
+		MaxBackoff:     cfg.RetryMaxBackoff,
+		MaxFailures:    cfg.MaxFailures,
+	}
+	c.Strategy = cfg.HealthStrategy
+	c.Concurrency = cfg.Concurrency
+	c.RequestTimeout = cfg.RequestTimeout
+	c.Watch = cfg.Watch
+	c.CheckMetrics = cfg.CheckMetrics
+	c.NodeMetrics = cfg.NodeMetrics
+	c.ExcludeNodeChecks = cfg.ExcludeNodeChecks
+	c.MaintenanceReasonTag = cfg.MaintenanceReasonTag
+	if c.ServiceFilter, err = NewFilter(cfg.ServiceInclude, cfg.ServiceExclude); err != nil {
+		return nil, err
+	}
+	if c.TagFilter, err = NewFilter(cfg.TagInclude, cfg.TagExclude); err != nil {
+		return nil, err
+	}
+	if c.TagRewriter, err = NewTagRewriter(cfg.TagRules); err != nil {
+		return nil, err
+	}
+	c.ServiceMetaTags = cfg.ServiceMetaTags
+	c.NodeMetaTags = cfg.NodeMetaTags
+	c.watchCoalesce = defaultWatchCoalesce
+	c.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	c.clock = realClock{}
+	if c.LockMode == ShardedLock {
+		memberID := cfg.MemberID
+		if memberID == "" {
+			if memberID, err = os.Hostname(); err != nil {
+				return nil, err
+			}
+		}
+		c.shard = newShardMembers(c, memberID)
+	}
 
 	return c, err
 }
 
-func (c *Collector) Run(stopCh <-chan struct{}, stoppedCh chan<- struct{}) error {
-	defer func() {
-		if stoppedCh != nil {
-			close(stoppedCh)
+// Run acquires the lock and collects on every tick while holding it,
+// reacquiring it if it's lost, until ctx is done, c.MaxTicks collections
+// have been made, or the retry policy's failure budget is exhausted.  In
+// per-datacenter lock mode, each datacenter is led independently, and a
+// leader giving up stops the others.  In sharded lock mode, the lock only
+// registers this collector as a member of the shard group, and it collects
+// from its share of the services.
+func (c *Collector) Run(ctx context.Context) error {
+	log.Infof("Electing leader with %s leader election", c.election)
+	if c.LockMode == ShardedLock {
+		return c.runSharded(ctx)
+	}
+	if c.LockMode != PerDatacenterLock {
+		return c.lead(ctx, c.lockKey, nil)
+	}
+
+	datacenters, err := c.resolveDatacenters(ctx.Done())
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errCh := make(chan error, len(datacenters))
+	for _, datacenter := range datacenters {
+		go func(datacenter string) {
+			errCh <- c.lead(ctx, c.lockKey+"/"+datacenter, []string{datacenter})
+		}(datacenter)
+	}
+
+	for range datacenters {
+		if leaderErr := <-errCh; leaderErr != nil && err == nil {
+			err = leaderErr
+			cancel()
 		}
-	}()
+	}
+	return err
+}
 
+// lead repeatedly acquires the lock at lockKey and collects from the given
+// datacenters while holding it, until ctx is done or the main loop returns.
+// A nil list of datacenters means those configured in c.Datacenters.
+//
+// Every attempt uses a fresh lock, and so a fresh Consul session, since a
+// lock can't be reused once it has been lost.  Failures to acquire the lock,
+// for instance while Consul has no leader, are retried every
+// lockRetryInterval.
+func (c *Collector) lead(ctx context.Context, lockKey string, datacenters []string) error {
 	for {
-		sigCh := make(chan os.Signal)
-		stopMainLoopCh := make(chan struct{})
-		log.Infof("Attempting to acquire lock at %s", c.lockKey)
-		lockLost, err := c.lock.Lock(nil)
+		lock, err := c.newLock(lockKey)
 		if err != nil {
 			return err
 		}
-		defer c.lock.Unlock()
-		log.Info("Lock acquired")
+		log.Infof("Attempting to acquire lock at %s", lockKey)
+		lockLost, err := lock.Lock(ctx.Done())
+		if err != nil {
+			log.Warnf("Failed to acquire lock at %s, retrying in %s: %s", lockKey, lockRetryInterval, err)
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-c.clock.After(lockRetryInterval):
+			}
+			continue
+		}
+		if lockLost == nil {
+			// ctx was done while waiting
+			return nil
+		}
 
-		go c.mainLoop(stopMainLoopCh, 0)
+		lost, err := c.holdLock(ctx, lockLost, lockKey, datacenters)
+		c.release(lock, lockKey)
+		if !lost {
+			return err
+		}
+	}
+}
 
-		signal.Notify(sigCh, os.Interrupt, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+// holdLock collects from the given datacenters for as long as the lock at
+// lockKey is held, until ctx is done or the main loop returns.  It reports
+// whether it stopped because the lock was lost, and otherwise returns the main
+// loop's error.
+func (c *Collector) holdLock(ctx context.Context, lockLost <-chan struct{}, lockKey string, datacenters []string) (lost bool, err error) {
+	log.Infof("Lock acquired at %s", lockKey)
+	c.stats.acquired(lockKey)
 
+	var f fence
+	for c.fencing() && f == nil {
+		session, err := c.lockSession(ctx.Done(), lockKey)
+		if err == errCollectionStopped {
+			return false, nil
+		}
+		if _, lost := err.(lockLostError); lost {
+			log.Warnf("Lost lock at %s before collecting under it: %s", lockKey, err)
+			c.stats.lost(lockKey)
+			return true, nil
+		}
+		if err == nil {
+			f = fence{lockKey: session}
+			continue
+		}
+		log.Warnf("Unable to tell which session holds the lock at %s, retrying in %s: %s", lockKey, lockRetryInterval, err)
 		select {
-		case signal := <-sigCh:
-			log.Infof("Received %s signal, terminating cleanly", signal)
-			close(stopMainLoopCh)
-			return nil
+		case <-ctx.Done():
+			return false, nil
 		case <-lockLost:
-			log.Info("Lost Consul lock!  Stopping service poller")
-			close(stopMainLoopCh)
-			c.lock.Unlock()
-			c.lock.Destroy()
-			break
-		case <-stopCh: // not normally closed, except in test cases
-			close(stopMainLoopCh)
-			return nil
+			log.Infof("Lost lock at %s!", lockKey)
+			c.stats.lost(lockKey)
+			return true, nil
+		case <-c.clock.After(lockRetryInterval):
 		}
 	}
-}
 
-func (c *Collector) mainLoop(stopLoopCh <-chan struct{}, stopAfterCount int) {
-	queryCount := 0
-	metricName := "consul.service.count"
-	queryOptions := consul.QueryOptions{}
+	loopCtx, stopMainLoop := context.WithCancel(ctx)
+	defer stopMainLoop()
+	mainLoopErrCh := make(chan error, 1)
+	go func() {
+		mainLoopErrCh <- c.mainLoop(loopCtx, datacenters, f)
+	}()
 
-	agentInfo, err := c.agentSelfFunc()
-	if err != nil {
-		log.Fatal(err)
+	select {
+	case err := <-mainLoopErrCh:
+		if err == errLeadershipLost {
+			log.Warnf("The lock at %s is no longer ours, giving it up", lockKey)
+			c.stats.lost(lockKey)
+			return true, nil
+		}
+		if err != nil {
+			log.Errorf("Giving up after %d consecutive failures", c.Retry.MaxFailures)
+		}
+		return false, err
+	case <-lockLost:
+		log.Infof("Lost lock at %s!  Stopping service poller", lockKey)
+		c.stats.lost(lockKey)
+		stopMainLoop()
+		<-mainLoopErrCh
+		return true, nil
+	}
+}
+
+// release releases lock, which was acquired at lockKey, and cleans up its
+// key.  Errors are only logged: a lock that was lost can't be released, and
+// the key can't be cleaned up once another instance has locked it.
+func (c *Collector) release(lock leaderLock, lockKey string) {
+	c.stats.released(lockKey)
+	if err := lock.Unlock(); err != nil && err != consul.ErrLockNotHeld {
+		log.Warnf("Failed to release lock at %s: %s", lockKey, err)
+	}
+	if err := lock.Destroy(); err != nil && err != consul.ErrLockInUse {
+		log.Warnf("Failed to clean up lock at %s: %s", lockKey, err)
 	}
-	datacenter := agentInfo["Config"]["Datacenter"].(string)
+}
 
-	ticker := time.NewTicker(c.collectInterval)
-	for {
-		queryCount++
-		if queryCount > 0 && queryCount > stopAfterCount {
-			return
+// mainLoop collects from the given datacenters (or those configured in
+// c.Datacenters, if nil) and posts metrics on every tick until ctx is done or
+// c.MaxTicks collections have been made.  In watch mode, metrics are also
+// posted shortly after any change to the health of a service.  Failed
+// collections are retried with exponential backoff; mainLoop only returns an
+// error once the retry policy's failure budget has been exhausted, or
+// errLeadershipLost once a lock of f turns out to have been lost.  Each batch
+// is fenced by f before being posted; if f merely couldn't be verified, the
+// collection is retried like any other failure, with the lock still held.
+func (c *Collector) mainLoop(ctx context.Context, datacenters []string, f fence) error {
+	var (
+		ticks               int
+		consecutiveFailures int
+		failedTicks         int
+		skippedTicks        int
+		nextAttempt         time.Time
+		retryCh             <-chan time.Time
+		changeCh            <-chan struct{}
+		coalesceCh          <-chan time.Time
+	)
+
+	source := c.pollingSource()
+	if c.Watch {
+		watchers := newDatacenterWatchers(c)
+		defer watchers.stop()
+		source = watchers.snapshot
+		changeCh = watchers.changed()
+
+		// Start watching straight away so that the initial counts can be
+		// published as soon as they're known.  If this fails, the watches are
+		// started on the first tick instead.
+		if datacenters != nil {
+			watchers.watch(datacenters...)
+		} else if resolved, err := c.resolveDatacenters(ctx.Done()); err == nil {
+			watchers.watch(resolved...)
 		}
+	}
+
+	ticker := c.clock.NewTicker(c.collectInterval)
+	defer ticker.Stop()
+	for c.MaxTicks <= 0 || ticks < c.MaxTicks {
 		select {
-		case <-stopLoopCh:
-			return
-		case <-ticker.C:
-			// wait for next tick, then leave select loop
+		case <-ctx.Done():
+			return nil
+		case now := <-ticker.Chan():
+			if now.Before(nextAttempt) {
+				// still backing off from a previous failure
+				skippedTicks++
+				continue
+			}
+		case <-retryCh:
+			// backoff period has elapsed; try again without waiting for the
+			// next tick
+		case <-changeCh:
+			// give related changes a moment to arrive before publishing
+			if coalesceCh == nil {
+				coalesceCh = c.clock.After(c.watchCoalesce)
+			}
+			continue
+		case now := <-coalesceCh:
+			if now.Before(nextAttempt) {
+				// the pending retry will publish the change
+				coalesceCh = nil
+				continue
+			}
 		}
+		retryCh = nil
+		coalesceCh = nil
 
-		services, _, err := c.catalogServicesFunc(&queryOptions)
-		if err != nil {
-			log.Fatal(err)
+		tickStart := c.clock.Now()
+		metrics, err := c.collect(source, datacenters, ctx.Done())
+		if err == errCollectionStopped {
+			return nil
+		}
+		if err == errWatchSyncing {
+			log.Debug("Skipping collection until watches have synced")
+			continue
+		}
+		verifyErr := c.verify(ctx.Done(), f)
+		if verifyErr == errCollectionStopped {
+			return nil
+		}
+		if err == nil && verifyErr != nil {
+			err = fmt.Errorf("unable to verify leadership: %s", verifyErr)
+		}
+		ticks++
+		// Post whatever we managed to collect, even if some datacenters
+		// failed.
+		selfTags := c.selfTags(datacenters)
+		metrics = append(metrics, c.selfMetrics(c.clock.Now().Sub(tickStart), len(metrics), selfTags)...)
+		if err == nil {
+			metrics = append(metrics, c.tickMetrics(failedTicks, skippedTicks, selfTags)...)
+		} else {
+			metrics = append(metrics, c.tickMetrics(failedTicks+1, skippedTicks, selfTags)...)
+		}
+		metrics = c.fenced(f, verifyErr, metrics, selfTags)
+		if err == nil {
+			err = c.sink.Send(metrics)
+		} else if postErr := c.sink.Send(metrics); postErr != nil {
+			log.Warnf("Failed to post metrics: %s", postErr)
+		}
+		c.status.tick(err)
+		if err == nil {
+			consecutiveFailures, failedTicks, skippedTicks = 0, 0, 0
+			nextAttempt = time.Time{}
+			continue
 		}
 
-		var metrics []datadog.Metric
+		consecutiveFailures++
+		failedTicks++
+		if c.Retry.MaxFailures > 0 && consecutiveFailures >= c.Retry.MaxFailures {
+			return err
+		}
+		if _, lost := verifyErr.(lockLostError); lost {
+			// The lock has been lost without us noticing yet, so step down
+			// rather than keep collecting under it.
+			return errLeadershipLost
+		}
+		delay := c.Retry.backoff(consecutiveFailures, c.rand)
+		log.Warnf("Collection failed (%d consecutive failures), retrying in %s: %s",
+			consecutiveFailures, delay, err)
+		nextAttempt = c.clock.Now().Add(delay)
+		retryCh = c.clock.After(delay)
+	}
+	return nil
+}
 
-		for serviceName := range services {
-			serviceHealth, _, err := c.healthServiceFunc(serviceName, "", false, &queryOptions)
+// tickMetrics returns the metrics describing the number of ticks that failed
+// or were skipped while backing off since metrics were last posted
+// successfully.
+func (c *Collector) tickMetrics(failedTicks, skippedTicks int, tags []string) []Metric {
+	return []Metric{
+		newMetric("consul2dogstats.tick.failed", float64(failedTicks), tags),
+		newMetric("consul2dogstats.tick.skipped", float64(skippedTicks), tags),
+	}
+}
+
+// CollectOnce performs a single collection and posts the resulting metrics,
+// returning an error if either failed.  If lock is true, the lock (or, in
+// per-datacenter lock mode, every datacenter's lock) is acquired first,
+// waiting for it if necessary, and released afterwards.  In sharded lock
+// mode, the collector registers as a member instead, and only collects from
+// its share of the services.  Health is always polled, even in watch mode.
+// If ctx is done before the collection is complete, nothing is posted and
+// ctx's error is returned.
+func (c *Collector) CollectOnce(ctx context.Context, lock bool) error {
+	f := make(fence)
+	if lock {
+		lockKeys := []string{c.lockKey}
+		if c.LockMode == ShardedLock {
+			lockKeys = []string{c.shard.key()}
+		}
+		if c.LockMode == PerDatacenterLock {
+			datacenters, err := c.resolveDatacenters(ctx.Done())
+			if err != nil {
+				return err
+			}
+			// Always take the locks in the same order, so that two
+			// collectors never wait on each other.
+			sort.Strings(datacenters)
+			lockKeys = nil
+			for _, datacenter := range datacenters {
+				lockKeys = append(lockKeys, c.lockKey+"/"+datacenter)
+			}
+		}
+		for _, lockKey := range lockKeys {
+			lock, err := c.newLock(lockKey)
 			if err != nil {
-				log.Fatal(err)
-			}
-			// Initialize the outer map that will be holding the service counts
-			// for us. The key of the outer map is the union of tags (in
-			// lexicographically sorted order, joined by the "|" character) for
-			// a given consul.ServiceEntry.  The value is a map of service
-			// statuses ("passing", "warning", "critical") to the count of each
-			// status.
-			countByTagsAndStatus := make(map[string]map[string]uint)
-		ENTRY:
-			for _, entry := range serviceHealth {
-				tags := entry.Service.Tags
-				sort.Strings(tags)
-				joinedTags := strings.Join(tags, "|")
-
-				// Initialize inner status map if necessary
-				if countByTagsAndStatus[joinedTags] == nil {
-					countByTagsAndStatus[joinedTags] = make(map[string]uint)
-					for _, status := range []string{"critical", "warning", "passing"} {
-						countByTagsAndStatus[joinedTags][status] = 0
+				return err
+			}
+			log.Infof("Attempting to acquire lock at %s", lockKey)
+			lockLost, err := lock.Lock(ctx.Done())
+			if err != nil {
+				return err
+			}
+			if lockLost == nil {
+				return ctx.Err()
+			}
+			defer c.release(lock, lockKey)
+			log.Infof("Lock acquired at %s", lockKey)
+			c.stats.acquired(lockKey)
+			if c.fencing() {
+				if f[lockKey], err = c.lockSession(ctx.Done(), lockKey); err != nil {
+					if err == errCollectionStopped {
+						return ctx.Err()
 					}
+					return err
 				}
-				for _, check := range entry.Checks {
-					// If any check returns critical, the status of the service is critical.
-					if check.Status == "critical" {
-						countByTagsAndStatus[joinedTags]["critical"]++
-						continue ENTRY
-					}
+			}
+		}
+		if c.LockMode == ShardedLock {
+			if err := c.loadShardMembers(ctx.Done()); err != nil {
+				if err == errCollectionStopped {
+					return ctx.Err()
 				}
-				for _, check := range entry.Checks {
-					// If any check returns warning, the status of the service is warning.
-					if check.Status == "warning" {
-						countByTagsAndStatus[joinedTags]["warning"]++
-						continue ENTRY
-					}
+				return err
+			}
+			defer c.shard.setRunning(false)
+		}
+	}
+
+	tickStart := c.clock.Now()
+	metrics, err := c.collect(c.pollingSource(), nil, ctx.Done())
+	if err == errCollectionStopped {
+		return ctx.Err()
+	}
+	verifyErr := c.verify(ctx.Done(), f)
+	if verifyErr == errCollectionStopped {
+		return ctx.Err()
+	}
+	if err == nil && verifyErr != nil {
+		err = fmt.Errorf("unable to verify leadership: %s", verifyErr)
+	}
+	failedTicks := 0
+	if err != nil {
+		failedTicks = 1
+	}
+	selfTags := c.selfTags(nil)
+	metrics = append(metrics, c.selfMetrics(c.clock.Now().Sub(tickStart), len(metrics), selfTags)...)
+	metrics = append(metrics, c.tickMetrics(failedTicks, 0, selfTags)...)
+	metrics = c.fenced(f, verifyErr, metrics, selfTags)
+	if postErr := c.sink.Send(metrics); err == nil {
+		err = postErr
+	} else if postErr != nil {
+		log.Warnf("Failed to post metrics: %s", postErr)
+	}
+	c.status.tick(err)
+	return err
+}
+
+// pollingSource returns the healthSource polling Consul according to
+// c.Strategy.
+func (c *Collector) pollingSource() healthSource {
+	if c.Strategy == BulkStrategy {
+		return c.bulkServiceHealth
+	}
+	return c.pollServiceHealth
+}
+
+// selfMetrics returns the consul2dogstats.* metrics describing a tick which
+// took duration to collect the given number of series, and what the
+// collector has been doing since the last tick.
+func (c *Collector) selfMetrics(duration time.Duration, series int, tags []string) []Metric {
+	return c.stats.metrics(duration, series, tags)
+}
+
+// selfTags returns the tags of the consul2dogstats.* metrics posted by a
+// leader collecting from the given datacenters.  In per-datacenter lock mode,
+// each leader's metrics are tagged with the datacenter it leads, so that
+// those of leaders of different datacenters don't collide.
+func (c *Collector) selfTags(datacenters []string) []string {
+	tags := []string{}
+	if c.datacenter != "" {
+		tags = append(tags, "datacenter:"+c.datacenter)
+	}
+	if c.LockMode == PerDatacenterLock && len(datacenters) == 1 {
+		tags = append(tags, "leader:"+datacenters[0])
+	}
+	if c.shard != nil {
+		tags = append(tags, "member:"+c.shard.id)
+	}
+	return tags
+}
+
+// healthSource returns the health entries of every service in the catalog of
+// the given datacenter, keyed by service name, along with every health check
+// in the datacenter if it fetched them on the way, or nil otherwise.  It
+// should give up and return errCollectionStopped if stopCh is closed while
+// it's waiting on Consul.
+type healthSource func(datacenter string, stopCh <-chan struct{}) (map[string][]*consul.ServiceEntry, consul.HealthChecks, error)
+
+// collect gathers the health of every service in the catalog of each of the
+// given datacenters (or those configured in c.Datacenters, if nil) from
+// source, and returns the resulting service counts.  If some datacenters
+// fail, the counts from the others are returned along with the error.
+func (c *Collector) collect(source healthSource, datacenters []string, stopCh <-chan struct{}) ([]Metric, error) {
+	if datacenters == nil {
+		var err error
+		if datacenters, err = c.resolveDatacenters(stopCh); err != nil {
+			return nil, err
+		}
+	}
+
+	var (
+		metrics []Metric
+		errs    []string
+		syncing bool
+	)
+	for _, datacenter := range datacenters {
+		health, checks, err := source(datacenter, stopCh)
+		switch err {
+		case nil:
+			health = c.shardHealth(datacenter, health)
+			c.status.sawServices(datacenter, len(health))
+			metrics = append(metrics, c.serviceMetrics(datacenter, health)...)
+			if c.CheckMetrics {
+				// In sharded lock mode, several members may see the checks
+				// of a node, so only the one counting nodes counts them.
+				metrics = append(metrics, checkMetrics(datacenter, health, c.ownsNodes(datacenter))...)
+			}
+			if c.NodeMetrics && c.ownsNodes(datacenter) {
+				nodeMetrics, err := c.nodeMetrics(datacenter, checks, stopCh)
+				if err == errCollectionStopped {
+					return nil, err
 				}
-				countByTagsAndStatus[joinedTags]["passing"]++
-			}
-
-			for joinedTags, countByStatus := range countByTagsAndStatus {
-				for checkStatus, count := range countByStatus {
-					tags := append(strings.Split(joinedTags, "|"),
-						"status:"+checkStatus,
-						"service:"+serviceName,
-						"datacenter:"+datacenter)
-					metric := datadog.Metric{
-						Metric: &metricName,
-						Points: []datadog.DataPoint{
-							{
-								float64(time.Now().Unix()),
-								float64(count),
-							},
-						},
-						Tags: tags,
-					}
-					metrics = append(metrics, metric)
+				if err != nil {
+					errs = append(errs, fmt.Sprintf("datacenter %s: %s", datacenter, err))
 				}
+				metrics = append(metrics, nodeMetrics...)
 			}
+		case errCollectionStopped:
+			return nil, err
+		case errWatchSyncing:
+			syncing = true
+		default:
+			errs = append(errs, fmt.Sprintf("datacenter %s: %s", datacenter, err))
 		}
-		if err := c.datadogClient.PostMetrics(metrics); err != nil {
-			log.Fatal(err)
+	}
+	if len(errs) > 0 {
+		return metrics, errors.New(strings.Join(errs, "; "))
+	}
+	if syncing && len(metrics) == 0 {
+		return nil, errWatchSyncing
+	}
+	return metrics, nil
+}
+
+// pollServiceHealth queries Consul for the catalog of a datacenter, then for
+// the health of each service in it.
+func (c *Collector) pollServiceHealth(datacenter string, stopCh <-chan struct{}) (map[string][]*consul.ServiceEntry, consul.HealthChecks, error) {
+	var services map[string][]string
+	err := c.call(stopCh, catalogServicesEndpoint, "service catalog", func(ctx context.Context) (err error) {
+		services, _, err = c.catalogServicesFunc((&consul.QueryOptions{Datacenter: datacenter}).WithContext(ctx))
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	services = c.shardCatalog(datacenter, c.ServiceFilter.filterCatalog(services))
+
+	serviceNames := make([]string, 0, len(services))
+	for serviceName := range services {
+		serviceNames = append(serviceNames, serviceName)
+	}
+	health, err := c.fetchServiceHealth(datacenter, serviceNames, stopCh)
+	return health, nil, err
+}
+
+// instanceState is the status of a service instance, and the reason for it:
+// "node" if it's due to a check of the node the instance runs on, "service"
+// if it's due to a check of the instance itself, or empty if it's passing.
+// Instances in maintenance mode may also carry the operator's note.
+type instanceState struct {
+	status, reason, note string
+}
+
+// statusSeverity ranks check statuses; the status of a service instance is
+// the most severe status of any of its checks.  Unknown statuses are treated
+// as passing.
+var statusSeverity = map[string]int{
+	"passing":  0,
+	"warning":  1,
+	"critical": 2,
+}
+
+// Consul implements maintenance mode as a critical check with one of these
+// IDs.
+const (
+	nodeMaintenanceCheckID        = "_node_maintenance"
+	serviceMaintenanceCheckPrefix = "_service_maintenance:"
+)
+
+// isNodeCheck returns true if check is a check of a node, such as
+// serfHealth, rather than of a service running on it.
+func isNodeCheck(check *consul.HealthCheck) bool {
+	return check.CheckID != "" && check.ServiceID == "" && check.ServiceName == ""
+}
+
+// isMaintenanceCheck returns true if check puts a node or service instance
+// into maintenance mode.
+func isMaintenanceCheck(check *consul.HealthCheck) bool {
+	return check.CheckID == nodeMaintenanceCheckID ||
+		strings.HasPrefix(check.CheckID, serviceMaintenanceCheckPrefix)
+}
+
+// entryState returns the state of a service instance.  An instance in
+// maintenance mode has the "maintenance" status regardless of its other
+// checks.  If both node and service checks have the instance's status, the
+// node is given as the reason, since a failing node usually explains its
+// failing services.
+func (c *Collector) entryState(entry *consul.ServiceEntry) instanceState {
+	var maintenance *consul.HealthCheck
+	for _, check := range entry.Checks {
+		if isMaintenanceCheck(check) && (maintenance == nil || isNodeCheck(check)) {
+			maintenance = check
+		}
+	}
+	if maintenance != nil {
+		state := instanceState{status: "maintenance", reason: "service"}
+		if isNodeCheck(maintenance) {
+			state.reason = "node"
+		}
+		if c.MaintenanceReasonTag {
+			state.note = maintenance.Notes
+		}
+		return state
+	}
+
+	state := instanceState{status: "passing"}
+	for _, check := range entry.Checks {
+		nodeCheck := isNodeCheck(check)
+		if nodeCheck && c.ExcludeNodeChecks {
+			continue
+		}
+		reason := "service"
+		if nodeCheck {
+			reason = "node"
+		}
+		switch {
+		case statusSeverity[check.Status] > statusSeverity[state.status]:
+			state = instanceState{status: check.Status, reason: reason}
+		case check.Status == state.status && state.status != "passing" && nodeCheck:
+			state.reason = reason
+		}
+	}
+	return state
+}
+
+// instanceStates lists the states every service count is reported for, even
+// when zero.
+func (c *Collector) instanceStates() []instanceState {
+	states := []instanceState{
+		{status: "passing"},
+		{status: "maintenance", reason: "node"},
+		{status: "maintenance", reason: "service"},
+	}
+	for _, status := range []string{"critical", "warning"} {
+		if !c.ExcludeNodeChecks {
+			states = append(states, instanceState{status: status, reason: "node"})
+		}
+		states = append(states, instanceState{status: status, reason: "service"})
+	}
+	return states
+}
+
+// tagCounts holds the number of service instances in each state which have
+// a particular set of tags.
+type tagCounts struct {
+	tags         tagSet
+	countByState map[instanceState]uint
+}
+
+// serviceMetrics counts the instances of each service by tags and state.
+func (c *Collector) serviceMetrics(datacenter string, health map[string][]*consul.ServiceEntry) []Metric {
+	metricName := "consul.service.count"
+
+	var metrics []Metric
+
+	for serviceName, serviceHealth := range health {
+		// Initialize the map that will be holding the service counts for
+		// us.  It's keyed by the tag set of a given consul.ServiceEntry, and
+		// holds the count of each instance state for that tag set.
+		countByTags := make(map[string]*tagCounts)
+		for _, entry := range serviceHealth {
+			tags := newTagSet(c.TagRewriter.Rewrite(c.TagFilter.filterTags(entry.Service.Tags)), c.metaTags(entry))
+
+			// Initialize the counts if necessary
+			counts := countByTags[tags.key()]
+			if counts == nil {
+				counts = &tagCounts{tags: tags, countByState: make(map[instanceState]uint)}
+				for _, state := range c.instanceStates() {
+					counts.countByState[state] = 0
+				}
+				countByTags[tags.key()] = counts
+			}
+			counts.countByState[c.entryState(entry)]++
+		}
+
+		for _, counts := range countByTags {
+			for state, count := range counts.countByState {
+				tags := counts.tags.with(
+					"status:"+state.status,
+					"service:"+serviceName,
+					"datacenter:"+datacenter)
+				if state.reason != "" {
+					tags = append(tags, "reason:"+state.reason)
+				}
+				if state.note != "" {
+					tags = append(tags, "maintenance_reason:"+state.note)
+				}
+				metrics = append(metrics, newMetric(metricName, float64(count), tags))
+			}
 		}
 	}
+	return metrics
 }
@@ -3,7 +3,6 @@ package consul2dogstats
 import (
 	"fmt"
 	"testing"
-	"time"
 
 	consul "github.com/hashicorp/consul/api"
 )
@@ -53,15 +52,17 @@ func TestLockReleasedAfterRun(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	locks := useTestLocks(c)
 
-	stopCh := make(chan struct{})
-	stoppedCh := make(chan struct{})
-	go c.Run(stopCh, stoppedCh)
-	time.Sleep(time.Second)
-	close(stopCh) // terminate loop
-	<-stoppedCh   // wait for loop to exit cleanly
+	clock := newTestClock()
+	c.clock = clock
+	stop := startCollector(c)
+	clock.tick(t, c.collectInterval) // wait for the lock to be taken
+	if err := stop(); err != nil {
+		t.Fatal(err)
+	}
 
-	if c.lock.(*testConsulLock).Locked() {
+	if !locks.released() {
 		t.Fatal("Consul lock was not released")
 	}
 }
@@ -126,8 +127,8 @@ func TestBasicSimpleServiceMetric(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	c.mainLoop(nil, 1)
-	for _, metric := range c.datadogClient.(*testDatadogClient).metrics {
+	c.runTicks(1)
+	for _, metric := range c.sink.(*testSink).metrics {
 		if stringInSlice("service:testService1", metric.Tags) {
 			foundService = true
 			if !stringInSlice("test", metric.Tags) {
@@ -141,7 +142,7 @@ func TestBasicSimpleServiceMetric(t *testing.T) {
 	if !foundService {
 		t.Fatal("failed to find 'service:testService1' tag in metric")
 	}
-	c.datadogClient.(*testDatadogClient).validateMetrics(t,
+	c.sink.(*testSink).validateMetrics(t,
 		[]string{"service:testService1"},
 		&testStatusCounts{passing: 1, warning: 0, critical: 0})
 }
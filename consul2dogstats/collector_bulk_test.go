@@ -0,0 +1,379 @@
+package consul2dogstats
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+// syntheticConsul mocks a datacenter with the given number of services, each
+// running a number of instances spread across nodes.  Every node has a
+// serfHealth check, and every instance a service check.  Every request made
+// to it sleeps for the given latency and is counted.  If index is set, it's
+// reported as the index of the service catalog.  Once a service has a
+// release, it's tagged with it.
+type syntheticConsul struct {
+	services  int
+	instances int
+	nodes     int
+	latency   time.Duration
+	index     uint64
+	releases  map[int]int
+	requests  int64
+}
+
+func (m *syntheticConsul) request() {
+	atomic.AddInt64(&m.requests, 1)
+	if m.latency > 0 {
+		time.Sleep(m.latency)
+	}
+}
+
+func (m *syntheticConsul) serviceName(i int) string { return fmt.Sprintf("service%d", i) }
+func (m *syntheticConsul) nodeName(i int) string    { return fmt.Sprintf("node%d", i) }
+
+// nodeStatus fails the serfHealth check of every seventh node.
+func (m *syntheticConsul) nodeStatus(node int) string {
+	if node%7 == 0 {
+		return "critical"
+	}
+	return "passing"
+}
+
+// serviceStatus marks every fifth instance as warning and every eleventh as
+// critical.
+func (m *syntheticConsul) serviceStatus(service, instance int) string {
+	switch n := service*m.instances + instance; {
+	case n%11 == 0:
+		return "critical"
+	case n%5 == 0:
+		return "warning"
+	}
+	return "passing"
+}
+
+func (m *syntheticConsul) serviceTags(service, instance int) []string {
+	return append(m.releaseTags(service), "environment:production", fmt.Sprintf("shard:%d", instance%3))
+}
+
+func (m *syntheticConsul) releaseTags(service int) []string {
+	if release, ok := m.releases[service]; ok {
+		return []string{fmt.Sprintf("release:%d", release)}
+	}
+	return nil
+}
+
+func (m *syntheticConsul) nodeCheck(node int) *consul.HealthCheck {
+	return &consul.HealthCheck{
+		Node:    m.nodeName(node),
+		CheckID: "serfHealth",
+		Name:    "Serf Health Status",
+		Status:  m.nodeStatus(node),
+	}
+}
+
+func (m *syntheticConsul) serviceCheck(service, instance int) *consul.HealthCheck {
+	name := m.serviceName(service)
+	id := fmt.Sprintf("%s-%d", name, instance)
+	return &consul.HealthCheck{
+		Node:        m.nodeName((service + instance) % m.nodes),
+		CheckID:     "service:" + id,
+		Name:        "Service '" + name + "' check",
+		Status:      m.serviceStatus(service, instance),
+		ServiceID:   id,
+		ServiceName: name,
+		ServiceTags: m.serviceTags(service, instance),
+	}
+}
+
+func (m *syntheticConsul) catalogServices(q *consul.QueryOptions) (map[string][]string, *consul.QueryMeta, error) {
+	m.request()
+	services := make(map[string][]string)
+	for i := 0; i < m.services; i++ {
+		services[m.serviceName(i)] = append(m.releaseTags(i), "environment:production")
+	}
+	return services, &consul.QueryMeta{LastIndex: m.index}, nil
+}
+
+func (m *syntheticConsul) catalogService(service, tag string, q *consul.QueryOptions) ([]*consul.CatalogService, *consul.QueryMeta, error) {
+	m.request()
+	var s int
+	if _, err := fmt.Sscanf(service, "service%d", &s); err != nil || s >= m.services {
+		return nil, nil, fmt.Errorf("Unknown service %s", service)
+	}
+	var instances []*consul.CatalogService
+	for i := 0; i < m.instances; i++ {
+		serviceCheck := m.serviceCheck(s, i)
+		instances = append(instances, &consul.CatalogService{
+			Node:        serviceCheck.Node,
+			ServiceID:   serviceCheck.ServiceID,
+			ServiceName: service,
+			ServiceTags: m.serviceTags(s, i),
+		})
+	}
+	return instances, nil, nil
+}
+
+func (m *syntheticConsul) healthService(service, tag string, passingOnly bool, q *consul.QueryOptions) ([]*consul.ServiceEntry, *consul.QueryMeta, error) {
+	m.request()
+	var s int
+	if _, err := fmt.Sscanf(service, "service%d", &s); err != nil || s >= m.services {
+		return nil, nil, fmt.Errorf("Unknown service %s", service)
+	}
+	var entries []*consul.ServiceEntry
+	for i := 0; i < m.instances; i++ {
+		serviceCheck := m.serviceCheck(s, i)
+		node := (s + i) % m.nodes
+		entries = append(entries, &consul.ServiceEntry{
+			Node: &consul.Node{Node: m.nodeName(node)},
+			Service: &consul.AgentService{
+				ID:      serviceCheck.ServiceID,
+				Service: service,
+				Tags:    m.serviceTags(s, i),
+			},
+			Checks: []*consul.HealthCheck{m.nodeCheck(node), serviceCheck},
+		})
+	}
+	return entries, nil, nil
+}
+
+func (m *syntheticConsul) healthState(state string, q *consul.QueryOptions) (consul.HealthChecks, *consul.QueryMeta, error) {
+	m.request()
+	var checks consul.HealthChecks
+	for i := 0; i < m.nodes; i++ {
+		checks = append(checks, m.nodeCheck(i))
+	}
+	for s := 0; s < m.services; s++ {
+		for i := 0; i < m.instances; i++ {
+			checks = append(checks, m.serviceCheck(s, i))
+		}
+	}
+	return checks, nil, nil
+}
+
+func (m *syntheticConsul) collectorConfig() *testCollectorConfig {
+	return &testCollectorConfig{
+		catalogServicesFunc: m.catalogServices,
+		healthServiceFunc:   m.healthService,
+		healthStateFunc:     m.healthState,
+		catalogServiceFunc:  m.catalogService,
+	}
+}
+
+// metricSet summarizes metrics as a sorted list of their tags and values,
+// so that batches can be compared regardless of ordering.
+func metricSet(metrics []Metric) []string {
+	var set []string
+	for _, metric := range metrics {
+		tags := append([]string(nil), metric.Tags...)
+		sort.Strings(tags)
+		set = append(set, fmt.Sprintf("%s{%s}=%v", metric.Name, strings.Join(tags, ","), metric.Value))
+	}
+	sort.Strings(set)
+	return set
+}
+
+func TestBulkStrategyMatchesPerService(t *testing.T) {
+	for name, cfg := range map[string]*testCollectorConfig{
+		"basic":      &basicTestCollectorConfig,
+		"multiTag":   {catalogServicesFunc: multiTagCatalogServices, healthServiceFunc: multiTagHealthService},
+		"multiCheck": {catalogServicesFunc: multiCheckCatalogServices, healthServiceFunc: multiCheckHealthService},
+		"synthetic":  (&syntheticConsul{services: 20, instances: 6, nodes: 9}).collectorConfig(),
+	} {
+		c, err := newTestCollector(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		perService, err := c.collect(c.pollServiceHealth, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bulk, err := c.collect(c.bulkServiceHealth, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want, got := metricSet(perService), metricSet(bulk); !reflect.DeepEqual(want, got) {
+			t.Fatalf("%s: bulk strategy produced\n%s\ninstead of\n%s", name,
+				strings.Join(got, "\n"), strings.Join(want, "\n"))
+		}
+	}
+}
+
+func TestBulkStrategyNodeChecks(t *testing.T) {
+	m := &syntheticConsul{services: 7, instances: 2, nodes: 7}
+	c, err := newTestCollector(m.collectorConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Strategy = BulkStrategy
+	c.runTicks(1)
+
+	// Both of service6's service checks are passing, but its second instance
+	// runs on node0, whose serfHealth check is failing.
+	c.sink.(*testSink).validateMetrics(t,
+		[]string{"service:service6"},
+		&testStatusCounts{passing: 1, warning: 0, critical: 1})
+}
+
+func TestBulkStrategyRequests(t *testing.T) {
+	m := &syntheticConsul{services: 50, instances: 3, nodes: 10, index: 1}
+	c, err := newTestCollector(m.collectorConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err = c.pollServiceHealth("dc1", nil); err != nil {
+		t.Fatal(err)
+	}
+	if m.requests != int64(m.services+1) {
+		t.Fatalf("expected per-service strategy to make %d requests, made %d", m.services+1, m.requests)
+	}
+
+	// The instances of every service are listed on the first collection, and
+	// then only those of services which have changed.
+	clock := newTestClock()
+	c.clock = clock
+	for i, step := range []struct {
+		change func()
+		want   int
+	}{
+		{func() {}, m.services + 2},
+		{func() {}, 2},
+		// another change to the catalog
+		{func() { m.index++ }, 2},
+		// a service's tags
+		{func() { m.releases = map[int]int{3: 1} }, 3},
+		// every service gains an instance with checks
+		{func() { m.instances++ }, m.services + 2},
+		{func() { clock.advance(instanceMaxAge) }, m.services + 2},
+	} {
+		step.change()
+		m.requests = 0
+		if _, _, err = c.bulkServiceHealth("dc1", nil); err != nil {
+			t.Fatal(err)
+		}
+		if m.requests != int64(step.want) {
+			t.Fatalf("expected bulk collection %d to make %d requests, made %d", i, step.want, m.requests)
+		}
+	}
+}
+
+// Instances without checks of their own don't appear in the health state at
+// all, but are listed by the catalog and counted as passing, whether or not
+// other instances of the same service have checks.
+func TestBulkStrategyPartiallyCheckedService(t *testing.T) {
+	c, err := newTestCollector(&testCollectorConfig{
+		catalogServicesFunc: multiTagCatalogServices,
+		healthServiceFunc: func(service, tag string, passingOnly bool, q *consul.QueryOptions) ([]*consul.ServiceEntry, *consul.QueryMeta, error) {
+			entries, meta, err := multiTagHealthService(service, tag, passingOnly, q)
+			if err != nil {
+				return nil, nil, err
+			}
+			entries[0].Checks[0].Status = "critical"
+			entries[1].Checks = nil
+			return entries, meta, nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Strategy = BulkStrategy
+	c.runTicks(1)
+
+	client := c.sink.(*testSink)
+	client.validateMetrics(t,
+		[]string{"service:testService1", "shard:1"},
+		&testStatusCounts{passing: 0, warning: 0, critical: 1})
+	client.validateMetrics(t,
+		[]string{"service:testService1", "shard:2"},
+		&testStatusCounts{passing: 1, warning: 0, critical: 0})
+}
+
+// Services without any checks don't appear in the health state at all, but
+// are still counted.
+func TestBulkStrategyUncheckedService(t *testing.T) {
+	c, err := newTestCollector(&testCollectorConfig{
+		catalogServicesFunc: basicCatalogServices,
+		healthServiceFunc: func(service, tag string, passingOnly bool, q *consul.QueryOptions) ([]*consul.ServiceEntry, *consul.QueryMeta, error) {
+			entries, meta, err := basicHealthService(service, tag, passingOnly, q)
+			if service == "testService2" {
+				for _, entry := range entries {
+					entry.Checks = nil
+				}
+			}
+			return entries, meta, err
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Strategy = BulkStrategy
+	c.runTicks(1)
+
+	c.sink.(*testSink).validateMetrics(t,
+		[]string{"service:testService2"},
+		&testStatusCounts{passing: 1, warning: 0, critical: 0})
+}
+
+func TestParseHealthStrategy(t *testing.T) {
+	for _, name := range []string{"per-service", "bulk"} {
+		if strategy, err := ParseHealthStrategy(name); err != nil || string(strategy) != name {
+			t.Fatalf("failed to parse %q: %v", name, err)
+		}
+	}
+	if _, err := ParseHealthStrategy("bogus"); err == nil {
+		t.Fatal("expected unknown strategy to be rejected")
+	}
+}
+
+// benchmarkStrategy measures collections from a datacenter with 200
+// services after a first one, which fills the bulk strategy's cache.  If
+// busy is true, the index of the service catalog changes on every tick, as
+// it does in a datacenter where instances of some service or other are
+// always coming and going.
+func benchmarkStrategy(b *testing.B, strategy HealthStrategy, busy bool) {
+	m := &syntheticConsul{services: 200, instances: 5, nodes: 50, latency: 100 * time.Microsecond, index: 1}
+	c, err := newTestCollector(m.collectorConfig())
+	if err != nil {
+		b.Fatal(err)
+	}
+	source := c.pollServiceHealth
+	if strategy == BulkStrategy {
+		source = c.bulkServiceHealth
+	}
+	if _, err := c.collect(source, nil, nil); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	atomic.StoreInt64(&m.requests, 0)
+	for i := 0; i < b.N; i++ {
+		if busy {
+			m.index++
+		}
+		if _, err := c.collect(source, nil, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.Logf("%.1f requests/op", float64(atomic.LoadInt64(&m.requests))/float64(b.N))
+}
+
+// Compare with BenchmarkBulkStrategy to see the reduction in requests and
+// latency per tick for a datacenter with 200 services.
+func BenchmarkPerServiceStrategy(b *testing.B) {
+	benchmarkStrategy(b, PerServiceStrategy, false)
+}
+
+func BenchmarkBulkStrategy(b *testing.B) {
+	benchmarkStrategy(b, BulkStrategy, false)
+}
+
+func BenchmarkBulkStrategyBusyCatalog(b *testing.B) {
+	benchmarkStrategy(b, BulkStrategy, true)
+}
@@ -0,0 +1,118 @@
+package consul2dogstats
+
+import (
+	"fmt"
+	"testing"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+// This mock catalog lists two instances of testService1, on testNode1 and
+// testNode2.  Each has an HTTP check and shares its node's Serf check.  The
+// HTTP check on testNode2 is critical, and the Serf check on testNode1 is
+// warning.
+func checkMetricsHealthService(service, tag string, passingOnly bool, q *consul.QueryOptions) ([]*consul.ServiceEntry, *consul.QueryMeta, error) {
+	if service != "testService1" {
+		return nil, nil, fmt.Errorf("Unknown service %s", service)
+	}
+	var serviceEntries []*consul.ServiceEntry
+	for _, instance := range []struct {
+		node, httpStatus, serfStatus string
+	}{
+		{"testNode1", "passing", "warning"},
+		{"testNode2", "critical", "passing"},
+	} {
+		serviceEntry := new(consul.ServiceEntry)
+		serviceEntry.Node = &consul.Node{Node: instance.node}
+		serviceEntry.Service = &consul.AgentService{ID: "testService1", Service: "testService1", Tags: []string{"test"}}
+		serviceEntry.Checks = []*consul.HealthCheck{
+			{Node: instance.node, CheckID: "serfHealth", Name: "Serf Health Status", Status: instance.serfStatus},
+			{Node: instance.node, CheckID: "service:testService1", Name: "HTTP health", Type: "http",
+				ServiceID: "testService1", ServiceName: "testService1", Status: instance.httpStatus},
+		}
+		serviceEntries = append(serviceEntries, serviceEntry)
+	}
+	return serviceEntries, nil, nil
+}
+
+func TestCheckMetricsDisabled(t *testing.T) {
+	c, err := newTestCollector(&testCollectorConfig{
+		catalogServicesFunc: multiCheckCatalogServices,
+		healthServiceFunc:   checkMetricsHealthService,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.runTicks(1)
+	for _, metric := range c.sink.(*testSink).metrics {
+		if metric.Name == "consul.check.count" {
+			t.Fatalf("unexpected check metric with tags %v", metric.Tags)
+		}
+	}
+}
+
+func TestCheckMetrics(t *testing.T) {
+	c, err := newTestCollector(&testCollectorConfig{
+		catalogServicesFunc: multiCheckCatalogServices,
+		healthServiceFunc:   checkMetricsHealthService,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.CheckMetrics = true
+	c.runTicks(1)
+
+	client := c.sink.(*testSink)
+	// the service rollup is unaffected
+	client.validateMetrics(t,
+		[]string{"test", "service:testService1"},
+		&testStatusCounts{passing: 0, warning: 1, critical: 1})
+
+	client.validateMetrics(t,
+		[]string{"check_id:service:testService1", "check_name:HTTP health", "check_type:http",
+			"service:testService1", "datacenter:dc1"},
+		&testStatusCounts{passing: 1, warning: 0, critical: 1})
+	client.validateMetrics(t,
+		[]string{"check_id:service:testService1", "node:testNode2"},
+		&testStatusCounts{passing: 0, warning: 0, critical: 1})
+	client.validateMetrics(t,
+		[]string{"check_id:serfHealth", "check_name:Serf Health Status"},
+		&testStatusCounts{passing: 1, warning: 1, critical: 0})
+	client.validateMetrics(t,
+		[]string{"check_id:serfHealth", "node:testNode1"},
+		&testStatusCounts{passing: 0, warning: 1, critical: 0})
+
+	for _, metric := range client.metrics {
+		if metric.Name != "consul.check.count" {
+			continue
+		}
+		if stringInSlice("check_id:serfHealth", metric.Tags) && stringInSlice("service:testService1", metric.Tags) {
+			t.Fatalf("node check tagged with service: %v", metric.Tags)
+		}
+	}
+}
+
+// A node check is reported by the health of every service instance on its
+// node, but should only be counted once.
+func TestCheckMetricsNodeChecksCountedOnce(t *testing.T) {
+	health := map[string][]*consul.ServiceEntry{}
+	for _, service := range []string{"testService1", "testService2"} {
+		health[service] = []*consul.ServiceEntry{{
+			Node:    &consul.Node{Node: "testNode1"},
+			Service: &consul.AgentService{ID: service, Service: service},
+			Checks: []*consul.HealthCheck{
+				{Node: "testNode1", CheckID: "serfHealth", Status: "critical"},
+				{Node: "testNode1", CheckID: "service:" + service, ServiceID: service, ServiceName: service, Status: "passing"},
+			},
+		}}
+	}
+
+	client := new(testSink)
+	client.Send(checkMetrics("dc1", health, true))
+	client.validateMetrics(t,
+		[]string{"check_id:serfHealth"},
+		&testStatusCounts{passing: 0, warning: 0, critical: 1})
+	client.validateMetrics(t,
+		[]string{"node:testNode1"},
+		&testStatusCounts{passing: 2, warning: 0, critical: 1})
+}
@@ -0,0 +1,222 @@
+package consul2dogstats
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+// concurrencyTracker wraps a mock of
+// https://godoc.org/github.com/hashicorp/consul/api#Health.Service, holding
+// each request open for a moment and recording how many were in flight at
+// once.
+type concurrencyTracker struct {
+	healthServiceFunc func(service, tag string, passingOnly bool, q *consul.QueryOptions) ([]*consul.ServiceEntry, *consul.QueryMeta, error)
+	delay             time.Duration
+
+	mtx         sync.Mutex
+	inFlight    int
+	maxInFlight int
+	requests    int
+}
+
+func (t *concurrencyTracker) healthService(service, tag string, passingOnly bool, q *consul.QueryOptions) ([]*consul.ServiceEntry, *consul.QueryMeta, error) {
+	t.mtx.Lock()
+	t.inFlight++
+	t.requests++
+	if t.inFlight > t.maxInFlight {
+		t.maxInFlight = t.inFlight
+	}
+	t.mtx.Unlock()
+
+	time.Sleep(t.delay)
+
+	t.mtx.Lock()
+	t.inFlight--
+	t.mtx.Unlock()
+	return t.healthServiceFunc(service, tag, passingOnly, q)
+}
+
+// blockingHealthService mocks a Consul agent that never answers.
+func blockingHealthService(service, tag string, passingOnly bool, q *consul.QueryOptions) ([]*consul.ServiceEntry, *consul.QueryMeta, error) {
+	select {}
+}
+
+func TestConcurrencyBounded(t *testing.T) {
+	m := &syntheticConsul{services: 40, instances: 3, nodes: 5}
+	tracker := &concurrencyTracker{healthServiceFunc: m.healthService, delay: 5 * time.Millisecond}
+	c, err := newTestCollector(&testCollectorConfig{
+		catalogServicesFunc: m.catalogServices,
+		healthServiceFunc:   tracker.healthService,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, concurrency := range []int{1, 3, 8} {
+		tracker.maxInFlight, tracker.requests = 0, 0
+		c.Concurrency = concurrency
+		health, _, err := c.pollServiceHealth("dc1", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(health) != m.services || tracker.requests != m.services {
+			t.Fatalf("expected %d services from %d requests, got %d from %d",
+				m.services, m.services, len(health), tracker.requests)
+		}
+		if tracker.maxInFlight > concurrency {
+			t.Fatalf("%d requests in flight with concurrency of %d", tracker.maxInFlight, concurrency)
+		}
+		if concurrency > 1 && tracker.maxInFlight < 2 {
+			t.Fatalf("requests were not made concurrently with concurrency of %d", concurrency)
+		}
+	}
+}
+
+func TestConcurrentResultsDeterministic(t *testing.T) {
+	m := &syntheticConsul{services: 30, instances: 4, nodes: 6}
+	c, err := newTestCollector(m.collectorConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Concurrency = 1
+	sequential, err := c.collect(c.pollServiceHealth, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := metricSet(sequential)
+
+	c.Concurrency = 10
+	for i := 0; i < 10; i++ {
+		concurrent, err := c.collect(c.pollServiceHealth, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := metricSet(concurrent); !reflect.DeepEqual(want, got) {
+			t.Fatalf("concurrent collection produced\n%s\ninstead of\n%s",
+				strings.Join(got, "\n"), strings.Join(want, "\n"))
+		}
+	}
+}
+
+func TestConcurrentMultiTagMetric(t *testing.T) {
+	c, err := newTestCollector(&testCollectorConfig{
+		catalogServicesFunc: multiTagCatalogServices,
+		healthServiceFunc:   multiTagHealthService,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Concurrency = 16
+	c.runTicks(1)
+
+	c.sink.(*testSink).validateMetrics(t,
+		[]string{"environment:production"},
+		&testStatusCounts{passing: 2, warning: 0, critical: 0})
+}
+
+func TestConcurrentServiceError(t *testing.T) {
+	c, err := newTestCollector(&testCollectorConfig{
+		// basicHealthService doesn't know about unknownService, so one of
+		// the requests fails
+		catalogServicesFunc: func(q *consul.QueryOptions) (map[string][]string, *consul.QueryMeta, error) {
+			services, _, _ := basicCatalogServices(q)
+			services["unknownService"] = nil
+			return services, nil, nil
+		},
+		healthServiceFunc: basicHealthService,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = c.pollServiceHealth("dc1", nil); err == nil || !strings.Contains(err.Error(), "unknownService") {
+		t.Fatalf("expected error for unknown service, got %v", err)
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	c, err := newTestCollector(&testCollectorConfig{
+		catalogServicesFunc: basicCatalogServices,
+		healthServiceFunc:   blockingHealthService,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.RequestTimeout = 20 * time.Millisecond
+
+	start := time.Now()
+	_, _, err = c.pollServiceHealth("dc1", nil)
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("expected timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("timeout took %s", elapsed)
+	}
+}
+
+// Requests abandoned after timing out are cancelled rather than left to
+// run in the background.
+func TestRequestTimeoutCancelsRequest(t *testing.T) {
+	cancelled := make(chan struct{}, 3)
+	c, err := newTestCollector(&testCollectorConfig{
+		catalogServicesFunc: basicCatalogServices,
+		healthServiceFunc: func(service, tag string, passingOnly bool, q *consul.QueryOptions) ([]*consul.ServiceEntry, *consul.QueryMeta, error) {
+			<-q.Context().Done()
+			cancelled <- struct{}{}
+			return nil, nil, q.Context().Err()
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.RequestTimeout = 20 * time.Millisecond
+
+	if _, _, err = c.pollServiceHealth("dc1", nil); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("expected timeout, got %v", err)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("timed out request was not cancelled")
+	}
+}
+
+func TestCollectionCancelledOnStop(t *testing.T) {
+	c, err := newTestCollector(&testCollectorConfig{
+		catalogServicesFunc: basicCatalogServices,
+		healthServiceFunc:   blockingHealthService,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.RequestTimeout = 0
+	c.collectInterval = time.Millisecond
+
+	c.MaxTicks = 1
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- c.mainLoop(ctx, nil, nil)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("mainLoop did not stop while waiting on Consul")
+	}
+	if metrics := c.sink.(*testSink).metricValues("consul.service.count"); len(metrics) != 0 {
+		t.Fatalf("expected no service counts to be posted, got %v", metrics)
+	}
+}
@@ -0,0 +1,191 @@
+package consul2dogstats
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+// filterTestConsul mocks a catalog of long-lived services and ephemeral
+// per-build ones, each with a single passing instance tagged with its
+// environment and the SHA of its build.  It records which services had
+// their health queried.
+type filterTestConsul struct {
+	mtx     sync.Mutex
+	queried []string
+}
+
+var filterTestServices = []string{"web", "web-canary", "api", "build-3f2a9c", "build-99bc01"}
+
+func (m *filterTestConsul) catalogServices(q *consul.QueryOptions) (map[string][]string, *consul.QueryMeta, error) {
+	services := make(map[string][]string)
+	for _, name := range filterTestServices {
+		services[name] = []string{"environment:production", "sha:" + name}
+	}
+	return services, nil, nil
+}
+
+func (m *filterTestConsul) healthService(service, tag string, passingOnly bool, q *consul.QueryOptions) ([]*consul.ServiceEntry, *consul.QueryMeta, error) {
+	m.mtx.Lock()
+	m.queried = append(m.queried, service)
+	m.mtx.Unlock()
+	for _, name := range filterTestServices {
+		if name == service {
+			return []*consul.ServiceEntry{{
+				Node:    &consul.Node{Node: "testNode1"},
+				Service: &consul.AgentService{ID: service, Service: service, Tags: []string{"environment:production", "sha:" + service}},
+				Checks:  []*consul.HealthCheck{{Node: "testNode1", CheckID: "service:" + service, ServiceID: service, ServiceName: service, Status: "passing"}},
+			}}, nil, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("Unknown service %s", service)
+}
+
+func (m *filterTestConsul) queriedServices() []string {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	queried := append([]string(nil), m.queried...)
+	sort.Strings(queried)
+	return queried
+}
+
+func TestPatterns(t *testing.T) {
+	for _, tc := range []struct {
+		pattern string
+		match   []string
+		noMatch []string
+	}{
+		{"web", []string{"web"}, []string{"web-canary", "webby", "api"}},
+		{"web*", []string{"web", "web-canary"}, []string{"api", "my-web"}},
+		{"build-??????", []string{"build-3f2a9c"}, []string{"build-3f2a", "build-3f2a9c0"}},
+		{"a.b", []string{"a.b"}, []string{"axb"}},
+		{"/^build-[0-9a-f]+$/", []string{"build-3f2a9c"}, []string{"build-xyz", "web"}},
+		{"/canary/", []string{"web-canary", "canary"}, []string{"web"}},
+	} {
+		p, err := ParsePattern(tc.pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range tc.match {
+			if !p.Match(name) {
+				t.Fatalf("expected %q to match %q", tc.pattern, name)
+			}
+		}
+		for _, name := range tc.noMatch {
+			if p.Match(name) {
+				t.Fatalf("expected %q not to match %q", tc.pattern, name)
+			}
+		}
+	}
+
+	if _, err := ParsePattern("/build-[/"); err == nil {
+		t.Fatal("expected invalid regular expression to be rejected")
+	}
+}
+
+func TestFilter(t *testing.T) {
+	var f *Filter
+	if !f.Match("anything") {
+		t.Fatal("expected nil filter to match everything")
+	}
+
+	f, err := NewFilter([]string{"web*", "api"}, []string{"*-canary"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kept []string
+	for _, name := range filterTestServices {
+		if f.Match(name) {
+			kept = append(kept, name)
+		}
+	}
+	if strings.Join(kept, ",") != "web,api" {
+		t.Fatalf("unexpected services kept: %v", kept)
+	}
+}
+
+func TestServiceFilter(t *testing.T) {
+	for _, strategy := range []HealthStrategy{PerServiceStrategy, BulkStrategy} {
+		m := new(filterTestConsul)
+		c, err := newTestCollector(&testCollectorConfig{
+			catalogServicesFunc: m.catalogServices,
+			healthServiceFunc:   m.healthService,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Strategy = strategy
+		c.ServiceFilter, _ = NewFilter(nil, []string{"/^build-/"})
+		c.runTicks(1)
+
+		client := c.sink.(*testSink)
+		client.validateMetrics(t,
+			[]string{},
+			&testStatusCounts{passing: 3, warning: 0, critical: 0})
+		for _, metric := range client.metrics {
+			for _, tag := range metric.Tags {
+				if strings.HasPrefix(tag, "service:build-") {
+					t.Fatalf("%s: excluded service reported: %v", strategy, metric.Tags)
+				}
+			}
+		}
+		if strategy == PerServiceStrategy {
+			if queried := m.queriedServices(); strings.Join(queried, ",") != "api,web,web-canary" {
+				t.Fatalf("expected only included services to be queried, got %v", queried)
+			}
+		}
+	}
+}
+
+func TestTagFilter(t *testing.T) {
+	m := new(filterTestConsul)
+	c, err := newTestCollector(&testCollectorConfig{
+		catalogServicesFunc: m.catalogServices,
+		healthServiceFunc:   m.healthService,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.TagFilter, _ = NewFilter(nil, []string{"sha:*"})
+	c.runTicks(1)
+
+	client := c.sink.(*testSink)
+	client.validateMetrics(t,
+		[]string{"environment:production"},
+		&testStatusCounts{passing: 5, warning: 0, critical: 0})
+	for _, metric := range client.metrics {
+		for _, tag := range metric.Tags {
+			if strings.HasPrefix(tag, "sha:") {
+				t.Fatalf("excluded tag forwarded: %v", metric.Tags)
+			}
+		}
+	}
+}
+
+// Instances whose tags differ only in excluded tags should be counted
+// together.
+func TestTagFilterMergesCounts(t *testing.T) {
+	c, err := newTestCollector(&testCollectorConfig{
+		catalogServicesFunc: multiTagCatalogServices,
+		healthServiceFunc:   multiTagHealthService,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.TagFilter, _ = NewFilter([]string{"environment:*"}, nil)
+	c.runTicks(1)
+
+	var passing []float64
+	for _, metric := range c.sink.(*testSink).metrics {
+		if metric.Name == "consul.service.count" && stringInSlice("status:passing", metric.Tags) {
+			passing = append(passing, metric.Value)
+		}
+	}
+	if len(passing) != 1 || passing[0] != 2 {
+		t.Fatalf("expected a single passing count of 2, got %v", passing)
+	}
+}
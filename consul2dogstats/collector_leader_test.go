@@ -0,0 +1,93 @@
+package consul2dogstats
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestLockReacquiredAfterRepeatedLoss(t *testing.T) {
+	c, err := newTestCollector(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	locks := useTestLocks(c)
+	clock := newTestClock()
+	c.clock = clock
+	stop := startCollector(c)
+
+	for term := 1; term <= 3; term++ {
+		waitFor(t, fmt.Sprintf("lock %d to be acquired", term), func() bool {
+			n, held := locks.held()
+			return n == term && held
+		})
+		// The second tick is only taken once the first collection is posted.
+		clock.tick(t, c.collectInterval)
+		clock.tick(t, c.collectInterval)
+		if term < 3 {
+			lost := locks.all()[term-1]
+			lost.LoseLock()
+			waitFor(t, fmt.Sprintf("lock %d to be released", term), func() bool {
+				return !lost.Locked() && lost.Destroyed()
+			})
+		}
+	}
+	if err := stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !locks.released() {
+		t.Fatal("Consul locks were not all released")
+	}
+	client := c.sink.(*testSink)
+	lockTag := "lock:" + c.lockKey
+	if acquired := client.sumMetric("consul2dogstats.lock.acquired", lockTag); acquired != 3 {
+		t.Fatalf("expected the lock to be acquired 3 times, got %v", acquired)
+	}
+	if lost := client.sumMetric("consul2dogstats.lock.lost", lockTag); lost != 2 {
+		t.Fatalf("expected the lock to be lost twice, got %v", lost)
+	}
+}
+
+func TestLockAcquisitionRetried(t *testing.T) {
+	c, err := newTestCollector(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	locks := useTestLocks(c)
+	locks.failures = 2
+	clock := newTestClock()
+	c.clock = clock
+	stop := startCollector(c)
+
+	waitFor(t, "lock to be acquired after Consul recovers", func() bool {
+		clock.advance(lockRetryInterval)
+		n, held := locks.held()
+		return n == 3 && held
+	})
+	clock.tick(t, c.collectInterval)
+	clock.tick(t, c.collectInterval)
+	if err := stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !locks.released() {
+		t.Fatal("Consul lock was not released")
+	}
+	if metrics := c.sink.(*testSink).metricValues("consul.service.count"); len(metrics) == 0 {
+		t.Fatal("expected counts to be posted once the lock was acquired")
+	}
+}
+
+func TestConsulLockOptions(t *testing.T) {
+	opts := DefaultLockOptions.consulLockOptions("c2d/lock")
+	if opts.Key != "c2d/lock" || opts.SessionName != "consul2dogstats" || opts.SessionTTL != "15s" ||
+		opts.MonitorRetries != 3 || opts.LockWaitTime != 15*time.Second {
+		t.Fatalf("unexpected lock options %+v", opts)
+	}
+
+	// Consul's defaults are used for unset options.
+	if opts := (LockOptions{}).consulLockOptions("c2d/lock"); opts.SessionTTL != "" || opts.LockWaitTime != 0 {
+		t.Fatalf("unexpected lock options %+v", opts)
+	}
+}
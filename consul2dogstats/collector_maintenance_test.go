@@ -0,0 +1,137 @@
+package consul2dogstats
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+// This mock catalog lists three instances of testService1:  one on a node in
+// maintenance mode, one itself in maintenance mode, and one critical.
+func maintenanceHealthService(service, tag string, passingOnly bool, q *consul.QueryOptions) ([]*consul.ServiceEntry, *consul.QueryMeta, error) {
+	if service != "testService1" {
+		return nil, nil, fmt.Errorf("Unknown service %s", service)
+	}
+	newEntry := func(node string, checks ...*consul.HealthCheck) *consul.ServiceEntry {
+		serviceEntry := new(consul.ServiceEntry)
+		serviceEntry.Node = &consul.Node{Node: node}
+		serviceEntry.Service = &consul.AgentService{ID: "testService1", Service: "testService1", Tags: []string{"test"}}
+		serviceEntry.Checks = append([]*consul.HealthCheck{
+			{Node: node, CheckID: "serfHealth", Status: "passing"},
+		}, checks...)
+		return serviceEntry
+	}
+	return []*consul.ServiceEntry{
+		newEntry("testNode1",
+			&consul.HealthCheck{Node: "testNode1", CheckID: "_node_maintenance", Status: "critical",
+				Notes: "kernel upgrade"},
+			&consul.HealthCheck{Node: "testNode1", CheckID: "service:testService1", ServiceID: "testService1",
+				ServiceName: "testService1", Status: "critical"}),
+		newEntry("testNode2",
+			&consul.HealthCheck{Node: "testNode2", CheckID: "_service_maintenance:testService1", ServiceID: "testService1",
+				ServiceName: "testService1", Status: "critical", Notes: "deploy"},
+			&consul.HealthCheck{Node: "testNode2", CheckID: "service:testService1", ServiceID: "testService1",
+				ServiceName: "testService1", Status: "passing"}),
+		newEntry("testNode3",
+			&consul.HealthCheck{Node: "testNode3", CheckID: "service:testService1", ServiceID: "testService1",
+				ServiceName: "testService1", Status: "critical"}),
+	}, nil, nil
+}
+
+// sumMetric adds up the values of the named metric posted with all the
+// given tags.
+func (c *testSink) sumMetric(name string, tags ...string) (sum float64) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+METRIC:
+	for _, metric := range c.metrics {
+		if metric.Name != name {
+			continue
+		}
+		for _, tag := range tags {
+			if !stringInSlice(tag, metric.Tags) {
+				continue METRIC
+			}
+		}
+		sum += metric.Value
+	}
+	return sum
+}
+
+func TestMaintenanceStatus(t *testing.T) {
+	c, err := newTestCollector(&testCollectorConfig{
+		catalogServicesFunc: multiCheckCatalogServices,
+		healthServiceFunc:   maintenanceHealthService,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.runTicks(1)
+
+	client := c.sink.(*testSink)
+	client.validateMetrics(t,
+		[]string{"service:testService1"},
+		&testStatusCounts{passing: 0, warning: 0, critical: 1})
+	for _, tc := range []struct {
+		tags []string
+		want float64
+	}{
+		{[]string{"status:maintenance"}, 2},
+		{[]string{"status:maintenance", "reason:node"}, 1},
+		{[]string{"status:maintenance", "reason:service"}, 1},
+	} {
+		if got := client.sumMetric("consul.service.count", tc.tags...); got != tc.want {
+			t.Fatalf("expected %v instances with tags %v, got %v", tc.want, tc.tags, got)
+		}
+	}
+
+	for _, metric := range client.metrics {
+		for _, tag := range metric.Tags {
+			if strings.HasPrefix(tag, "maintenance_reason:") {
+				t.Fatalf("unexpected maintenance reason tag %s", tag)
+			}
+		}
+	}
+}
+
+func TestMaintenanceReasonTag(t *testing.T) {
+	c, err := newTestCollector(&testCollectorConfig{
+		catalogServicesFunc: multiCheckCatalogServices,
+		healthServiceFunc:   maintenanceHealthService,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.MaintenanceReasonTag = true
+	c.runTicks(1)
+
+	client := c.sink.(*testSink)
+	if got := client.sumMetric("consul.service.count", "reason:node", "maintenance_reason:kernel upgrade"); got != 1 {
+		t.Fatalf("expected 1 instance on a node under maintenance for a kernel upgrade, got %v", got)
+	}
+	if got := client.sumMetric("consul.service.count", "reason:service", "maintenance_reason:deploy"); got != 1 {
+		t.Fatalf("expected 1 instance under maintenance for a deploy, got %v", got)
+	}
+}
+
+func TestMaintenanceCheckMetrics(t *testing.T) {
+	c, err := newTestCollector(&testCollectorConfig{
+		catalogServicesFunc: multiCheckCatalogServices,
+		healthServiceFunc:   maintenanceHealthService,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.CheckMetrics = true
+	c.runTicks(1)
+
+	client := c.sink.(*testSink)
+	if got := client.sumMetric("consul.check.count", "check_id:_node_maintenance", "status:maintenance"); got != 1 {
+		t.Fatalf("expected node maintenance check to be counted as maintenance, got %v", got)
+	}
+	if got := client.sumMetric("consul.check.count", "status:critical"); got != 2 {
+		t.Fatalf("expected 2 critical checks, got %v", got)
+	}
+}
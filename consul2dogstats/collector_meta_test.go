@@ -0,0 +1,108 @@
+package consul2dogstats
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+// This mock catalog lists three instances of testService1, whose services
+// and nodes carry metadata.
+func metaHealthService(service, tag string, passingOnly bool, q *consul.QueryOptions) ([]*consul.ServiceEntry, *consul.QueryMeta, error) {
+	if service != "testService1" {
+		return nil, nil, fmt.Errorf("Unknown service %s", service)
+	}
+	var serviceEntries []*consul.ServiceEntry
+	for i, instance := range []struct {
+		team, tier, az, status string
+	}{
+		{"payments", "web", "us-east-1a", "passing"},
+		{"payments", "web", "us-east-1b", "critical"},
+		{"payments", "", "us-east-1b", "passing"},
+	} {
+		node := fmt.Sprintf("testNode%d", i+1)
+		serviceEntry := new(consul.ServiceEntry)
+		serviceEntry.Node = &consul.Node{Node: node, Meta: map[string]string{
+			"availability_zone": instance.az,
+			"instance_id":       fmt.Sprintf("i-%08d", i),
+		}}
+		serviceEntry.Service = &consul.AgentService{Service: "testService1", Tags: []string{"test"}, Meta: map[string]string{
+			"team":    instance.team,
+			"tier":    instance.tier,
+			"git_sha": fmt.Sprintf("%040d", i),
+		}}
+		serviceEntry.Checks = []*consul.HealthCheck{{Node: node, ServiceName: "testService1", Status: instance.status}}
+		serviceEntries = append(serviceEntries, serviceEntry)
+	}
+	return serviceEntries, nil, nil
+}
+
+func TestMetaTagsDisabled(t *testing.T) {
+	c, err := newTestCollector(&testCollectorConfig{
+		catalogServicesFunc: multiTagCatalogServices,
+		healthServiceFunc:   metaHealthService,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.runTicks(1)
+
+	for _, metric := range c.sink.(*testSink).metrics {
+		for _, tag := range metric.Tags {
+			if strings.HasPrefix(tag, "team:") || strings.HasPrefix(tag, "availability_zone:") {
+				t.Fatalf("unexpected metadata tag %s", tag)
+			}
+		}
+	}
+	c.sink.(*testSink).validateMetrics(t,
+		[]string{"test"},
+		&testStatusCounts{passing: 2, warning: 0, critical: 1})
+}
+
+func TestMetaTags(t *testing.T) {
+	c, err := newTestCollector(&testCollectorConfig{
+		catalogServicesFunc: multiTagCatalogServices,
+		healthServiceFunc:   metaHealthService,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.ServiceMetaTags = []string{"team", "tier"}
+	c.NodeMetaTags = []string{"availability_zone"}
+	c.runTicks(1)
+
+	client := c.sink.(*testSink)
+	for _, metric := range client.metrics {
+		for _, tag := range metric.Tags {
+			if strings.HasPrefix(tag, "git_sha:") || strings.HasPrefix(tag, "instance_id:") || tag == "tier:" {
+				t.Fatalf("unexpected metadata tag %s", tag)
+			}
+		}
+	}
+	client.validateMetrics(t,
+		[]string{"team:payments"},
+		&testStatusCounts{passing: 2, warning: 0, critical: 1})
+	client.validateMetrics(t,
+		[]string{"tier:web", "availability_zone:us-east-1b"},
+		&testStatusCounts{passing: 0, warning: 0, critical: 1})
+	client.validateMetrics(t,
+		[]string{"availability_zone:us-east-1b"},
+		&testStatusCounts{passing: 1, warning: 0, critical: 1})
+}
+
+// Changes to metadata should be picked up by watches.
+func TestHealthDigestIncludesMeta(t *testing.T) {
+	entries, _, _ := metaHealthService("testService1", "", false, nil)
+	before := healthDigest(entries)
+	entries[0].Node.Meta["availability_zone"] = "us-east-1c"
+	if healthDigest(entries) == before {
+		t.Fatal("node metadata change not reflected in digest")
+	}
+	before = healthDigest(entries)
+	entries[0].Service.Meta["team"] = "billing"
+	if healthDigest(entries) == before {
+		t.Fatal("service metadata change not reflected in digest")
+	}
+}
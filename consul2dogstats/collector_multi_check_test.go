@@ -42,8 +42,8 @@ func TestMultiCheckMetric(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	c.mainLoop(nil, 1)
-	for _, metric := range c.datadogClient.(*testDatadogClient).metrics {
+	c.runTicks(1)
+	for _, metric := range c.sink.(*testSink).metrics {
 		if stringInSlice("service:testService1", metric.Tags) {
 			foundService = true
 			if !stringInSlice("test", metric.Tags) {
@@ -58,7 +58,7 @@ func TestMultiCheckMetric(t *testing.T) {
 	if !foundService {
 		t.Fatal("failed to find 'service:testService1' tag in metric")
 	}
-	c.datadogClient.(*testDatadogClient).validateMetrics(t,
+	c.sink.(*testSink).validateMetrics(t,
 		[]string{},
 		&testStatusCounts{passing: 0, warning: 0, critical: 1})
 }
@@ -0,0 +1,275 @@
+package consul2dogstats
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+// This mock WAN federation has three datacenters.  dc1 runs one instance of
+// testService1, dc2 runs two, and dc3 runs none, but has testService2 instead.
+func multiDCCatalogDatacenters() ([]string, error) {
+	return []string{"dc3", "dc1", "dc2"}, nil
+}
+
+func multiDCCatalogServices(q *consul.QueryOptions) (map[string][]string, *consul.QueryMeta, error) {
+	services := make(map[string][]string)
+	switch q.Datacenter {
+	case "dc1", "dc2":
+		services["testService1"] = []string{"test"}
+	case "dc3":
+		services["testService2"] = []string{"test"}
+	default:
+		return nil, nil, fmt.Errorf("No path to datacenter %s", q.Datacenter)
+	}
+	return services, nil, nil
+}
+
+func multiDCHealthService(service, tag string, passingOnly bool, q *consul.QueryOptions) ([]*consul.ServiceEntry, *consul.QueryMeta, error) {
+	entries, meta, err := basicHealthService(service, tag, passingOnly, q)
+	if err != nil || q.Datacenter != "dc2" {
+		return entries, meta, err
+	}
+	second := *entries[0]
+	second.Checks = []*consul.HealthCheck{{Node: "testNode2", ServiceName: service, Status: "critical"}}
+	return append(entries, &second), meta, nil
+}
+
+var multiDCTestCollectorConfig = testCollectorConfig{
+	catalogServicesFunc: multiDCCatalogServices,
+	healthServiceFunc:   multiDCHealthService,
+}
+
+func TestLocalDatacenterOnly(t *testing.T) {
+	c, err := newTestCollector(&multiDCTestCollectorConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.catalogDatacentersFunc = multiDCCatalogDatacenters
+	c.runTicks(1)
+
+	client := c.sink.(*testSink)
+	client.validateMetrics(t,
+		[]string{"datacenter:dc1"},
+		&testStatusCounts{passing: 1, warning: 0, critical: 0})
+	client.validateMetrics(t,
+		[]string{"datacenter:dc2"},
+		&testStatusCounts{passing: 0, warning: 0, critical: 0})
+}
+
+func TestDatacenterAllowList(t *testing.T) {
+	c, err := newTestCollector(&multiDCTestCollectorConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.catalogDatacentersFunc = multiDCCatalogDatacenters
+	c.Datacenters = []string{"dc1", "dc2"}
+	c.runTicks(1)
+
+	client := c.sink.(*testSink)
+	client.validateMetrics(t,
+		[]string{"datacenter:dc1", "service:testService1"},
+		&testStatusCounts{passing: 1, warning: 0, critical: 0})
+	client.validateMetrics(t,
+		[]string{"datacenter:dc2", "service:testService1"},
+		&testStatusCounts{passing: 1, warning: 0, critical: 1})
+	client.validateMetrics(t,
+		[]string{"datacenter:dc3"},
+		&testStatusCounts{passing: 0, warning: 0, critical: 0})
+}
+
+func TestAllDatacenters(t *testing.T) {
+	c, err := newTestCollector(&multiDCTestCollectorConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.catalogDatacentersFunc = multiDCCatalogDatacenters
+	c.Datacenters = []string{AllDatacenters}
+
+	datacenters, err := c.resolveDatacenters(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(datacenters, ",") != "dc1,dc2,dc3" {
+		t.Fatalf("unexpected datacenters %v", datacenters)
+	}
+
+	c.runTicks(1)
+	client := c.sink.(*testSink)
+	client.validateMetrics(t,
+		[]string{"service:testService1"},
+		&testStatusCounts{passing: 2, warning: 0, critical: 1})
+	client.validateMetrics(t,
+		[]string{"datacenter:dc3", "service:testService2"},
+		&testStatusCounts{passing: 1, warning: 0, critical: 0})
+}
+
+func TestDatacenterEnumerationFailure(t *testing.T) {
+	c, err := newTestCollector(&multiDCTestCollectorConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.catalogDatacentersFunc = func() ([]string, error) {
+		return nil, errors.New("Unexpected response code: 500")
+	}
+	c.Datacenters = []string{AllDatacenters}
+
+	if _, err := c.collect(c.pollServiceHealth, nil, nil); err == nil {
+		t.Fatal("expected collection to fail")
+	}
+}
+
+// A datacenter that can't be reached shouldn't prevent the others from being
+// published, but should still count as a failure.
+func TestUnreachableDatacenter(t *testing.T) {
+	c, err := newTestCollector(&multiDCTestCollectorConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Datacenters = []string{"dc1", "dc4"}
+	c.collectInterval = 50 * time.Millisecond
+
+	metrics, err := c.collect(c.pollServiceHealth, nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "dc4") {
+		t.Fatalf("expected dc4 to fail, got %v", err)
+	}
+	if len(metrics) == 0 {
+		t.Fatal("expected metrics from dc1")
+	}
+
+	c.runTicks(1)
+	client := c.sink.(*testSink)
+	client.validateMetrics(t,
+		[]string{"datacenter:dc1"},
+		&testStatusCounts{passing: 1, warning: 0, critical: 0})
+	if failed := client.metricValues("consul2dogstats.tick.failed"); len(failed) != 1 || failed[0] != 1 {
+		t.Fatalf("expected failed tick to be reported, got %v", failed)
+	}
+}
+
+func TestMultiDatacenterWatch(t *testing.T) {
+	c, err := newTestCollector(&multiDCTestCollectorConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Datacenters = []string{"dc1", "dc2"}
+	c.Watch = true
+	c.watchCoalesce = 10 * time.Millisecond
+	c.collectInterval = time.Hour
+
+	stop := startMainLoop(c)
+	defer stop()
+
+	client := c.sink.(*testSink)
+	waitFor(t, "counts from both datacenters", func() bool {
+		return client.hasMetric(1, "datacenter:dc1", "status:passing") &&
+			client.hasMetric(1, "datacenter:dc2", "status:critical")
+	})
+}
+
+// recordingLocks creates mock Consul locks, keeping track of which are held.
+type recordingLocks struct {
+	mtx  sync.Mutex
+	held map[string]bool
+}
+
+type recordedLock struct {
+	*testConsulLock
+	locks *recordingLocks
+	key   string
+}
+
+func (r *recordingLocks) newLock(key string) (leaderLock, error) {
+	lock, err := lockKey(key)
+	r.set(key, false)
+	return &recordedLock{lock, r, key}, err
+}
+
+func (r *recordingLocks) set(key string, held bool) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.held[key] = held
+}
+
+func (r *recordingLocks) keys() []string {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	var keys []string
+	for key := range r.held {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (r *recordingLocks) locked(key string) bool {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.held[key]
+}
+
+func (l *recordedLock) Lock(stopCh <-chan struct{}) (<-chan struct{}, error) {
+	lockLost, err := l.testConsulLock.Lock(stopCh)
+	l.locks.set(l.key, true)
+	return lockLost, err
+}
+
+func (l *recordedLock) Unlock() error {
+	l.locks.set(l.key, false)
+	return l.testConsulLock.Unlock()
+}
+
+func TestPerDatacenterLocks(t *testing.T) {
+	c, err := newTestCollector(&multiDCTestCollectorConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	locks := &recordingLocks{held: make(map[string]bool)}
+	c.newLock = locks.newLock
+	c.catalogDatacentersFunc = multiDCCatalogDatacenters
+	c.Datacenters = []string{AllDatacenters}
+	c.LockMode = PerDatacenterLock
+
+	c.clock = newTestClock()
+	stop := startCollector(c)
+
+	wantKeys := "consul2dogstats/test_lock/dc1,consul2dogstats/test_lock/dc2,consul2dogstats/test_lock/dc3"
+	waitFor(t, "per-datacenter locks", func() bool {
+		keys := locks.keys()
+		if strings.Join(keys, ",") != wantKeys {
+			return false
+		}
+		for _, key := range keys {
+			if !locks.locked(key) {
+				return false
+			}
+		}
+		return true
+	})
+
+	if err := stop(); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range locks.keys() {
+		if locks.locked(key) {
+			t.Fatalf("lock %s was not released", key)
+		}
+	}
+}
+
+func TestParseLockMode(t *testing.T) {
+	for _, name := range []string{"shared", "per-datacenter"} {
+		if mode, err := ParseLockMode(name); err != nil || string(mode) != name {
+			t.Fatalf("failed to parse %q: %v", name, err)
+		}
+	}
+	if _, err := ParseLockMode("bogus"); err == nil {
+		t.Fatal("expected unknown lock mode to be rejected")
+	}
+}
@@ -48,10 +48,10 @@ func TestMultiTagMetric(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	c.mainLoop(nil, 1)
+	c.runTicks(1)
 
 	tagsFound := make(map[string]bool)
-	for _, metric := range c.datadogClient.(*testDatadogClient).metrics {
+	for _, metric := range c.sink.(*testSink).metrics {
 		for _, tag := range metric.Tags {
 			tagsFound[tag] = true
 		}
@@ -61,10 +61,10 @@ func TestMultiTagMetric(t *testing.T) {
 			t.Fatalf("failed to find '%s' tag in metric", tag)
 		}
 	}
-	c.datadogClient.(*testDatadogClient).validateMetrics(t,
+	c.sink.(*testSink).validateMetrics(t,
 		[]string{"environment:production"},
 		&testStatusCounts{passing: 2, warning: 0, critical: 0})
-	c.datadogClient.(*testDatadogClient).validateMetrics(t,
+	c.sink.(*testSink).validateMetrics(t,
 		[]string{"shard:1"},
 		&testStatusCounts{passing: 1, warning: 0, critical: 0})
 }
@@ -0,0 +1,97 @@
+package consul2dogstats
+
+import (
+	"fmt"
+	"testing"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+// This mock catalog lists four instances of testService1, each on its own
+// node, with a node check (serfHealth) and a service check:
+//
+//	testNode1: node critical, service passing
+//	testNode2: node passing, service critical
+//	testNode3: node warning, service warning
+//	testNode4: node passing, service warning
+func nodeChecksHealthService(service, tag string, passingOnly bool, q *consul.QueryOptions) ([]*consul.ServiceEntry, *consul.QueryMeta, error) {
+	if service != "testService1" {
+		return nil, nil, fmt.Errorf("Unknown service %s", service)
+	}
+	var serviceEntries []*consul.ServiceEntry
+	for _, instance := range []struct {
+		node, nodeStatus, serviceStatus string
+	}{
+		{"testNode1", "critical", "passing"},
+		{"testNode2", "passing", "critical"},
+		{"testNode3", "warning", "warning"},
+		{"testNode4", "passing", "warning"},
+	} {
+		serviceEntry := new(consul.ServiceEntry)
+		serviceEntry.Node = &consul.Node{Node: instance.node}
+		serviceEntry.Service = &consul.AgentService{ID: "testService1", Service: "testService1", Tags: []string{"test"}}
+		serviceEntry.Checks = []*consul.HealthCheck{
+			{Node: instance.node, CheckID: "serfHealth", Status: instance.nodeStatus},
+			{Node: instance.node, CheckID: "service:testService1", ServiceID: "testService1",
+				ServiceName: "testService1", Status: instance.serviceStatus},
+		}
+		serviceEntries = append(serviceEntries, serviceEntry)
+	}
+	return serviceEntries, nil, nil
+}
+
+func TestNodeCheckReason(t *testing.T) {
+	c, err := newTestCollector(&testCollectorConfig{
+		catalogServicesFunc: multiCheckCatalogServices,
+		healthServiceFunc:   nodeChecksHealthService,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.runTicks(1)
+
+	client := c.sink.(*testSink)
+	client.validateMetrics(t,
+		[]string{"service:testService1"},
+		&testStatusCounts{passing: 0, warning: 2, critical: 2})
+	client.validateMetrics(t,
+		[]string{"service:testService1", "reason:node"},
+		&testStatusCounts{passing: 0, warning: 1, critical: 1})
+	client.validateMetrics(t,
+		[]string{"service:testService1", "reason:service"},
+		&testStatusCounts{passing: 0, warning: 1, critical: 1})
+
+	for _, metric := range client.metrics {
+		if stringInSlice("status:passing", metric.Tags) &&
+			(stringInSlice("reason:node", metric.Tags) || stringInSlice("reason:service", metric.Tags)) {
+			t.Fatalf("passing count tagged with reason: %v", metric.Tags)
+		}
+	}
+}
+
+func TestExcludeNodeChecks(t *testing.T) {
+	c, err := newTestCollector(&testCollectorConfig{
+		catalogServicesFunc: multiCheckCatalogServices,
+		healthServiceFunc:   nodeChecksHealthService,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.ExcludeNodeChecks = true
+	c.runTicks(1)
+
+	client := c.sink.(*testSink)
+	client.validateMetrics(t,
+		[]string{"service:testService1"},
+		&testStatusCounts{passing: 1, warning: 2, critical: 1})
+	client.validateMetrics(t,
+		[]string{"service:testService1", "reason:service"},
+		&testStatusCounts{passing: 0, warning: 2, critical: 1})
+
+	for _, metric := range client.metrics {
+		// node maintenance is still recognised
+		if stringInSlice("reason:node", metric.Tags) && !stringInSlice("status:maintenance", metric.Tags) {
+			t.Fatalf("unexpected node reason with node checks excluded: %v", metric.Tags)
+		}
+	}
+}
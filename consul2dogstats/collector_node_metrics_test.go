@@ -0,0 +1,150 @@
+package consul2dogstats
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+// This mock catalog has five nodes across two racks:
+//
+//	testNode1: rack a, serfHealth passing
+//	testNode2: rack a, serfHealth critical, service check passing
+//	testNode3: rack b, in maintenance mode, serfHealth passing
+//	testNode4: rack b, disk check warning, service check critical
+//	testNode5: no rack, no checks
+func nodeMetricsCatalogNodes(q *consul.QueryOptions) ([]*consul.Node, *consul.QueryMeta, error) {
+	return []*consul.Node{
+		{Node: "testNode1", Meta: map[string]string{"rack": "a"}},
+		{Node: "testNode2", Meta: map[string]string{"rack": "a"}},
+		{Node: "testNode3", Meta: map[string]string{"rack": "b"}},
+		{Node: "testNode4", Meta: map[string]string{"rack": "b", "os": "linux"}},
+		{Node: "testNode5"},
+	}, nil, nil
+}
+
+func nodeMetricsHealthState(state string, q *consul.QueryOptions) (consul.HealthChecks, *consul.QueryMeta, error) {
+	return consul.HealthChecks{
+		{Node: "testNode1", CheckID: "serfHealth", Status: "passing"},
+		{Node: "testNode2", CheckID: "serfHealth", Status: "critical"},
+		{Node: "testNode2", CheckID: "service:testService1", ServiceID: "testService1",
+			ServiceName: "testService1", Status: "passing"},
+		{Node: "testNode3", CheckID: nodeMaintenanceCheckID, Status: "critical"},
+		{Node: "testNode3", CheckID: "serfHealth", Status: "passing"},
+		{Node: "testNode4", CheckID: "disk", Status: "warning"},
+		{Node: "testNode4", CheckID: "service:testService1", ServiceID: "testService1",
+			ServiceName: "testService1", Status: "critical"},
+		// Checks of nodes no longer in the catalog are ignored.
+		{Node: "testNode6", CheckID: "serfHealth", Status: "critical"},
+	}, nil, nil
+}
+
+func newNodeMetricsTestCollector(t *testing.T) *Collector {
+	c, err := newTestCollector(&testCollectorConfig{
+		catalogServicesFunc: basicCatalogServices,
+		healthServiceFunc:   basicHealthService,
+		healthStateFunc:     nodeMetricsHealthState,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.catalogNodesFunc = nodeMetricsCatalogNodes
+	c.NodeMetrics = true
+	c.NodeMetaTags = []string{"rack"}
+	return c
+}
+
+// nodeCounts returns the values of the consul.node.count metrics, keyed by
+// their sorted, comma-separated tags.
+func nodeCounts(metrics []Metric) map[string]float64 {
+	counts := make(map[string]float64)
+	for _, metric := range metrics {
+		if metric.Name != "consul.node.count" {
+			continue
+		}
+		tags := append([]string(nil), metric.Tags...)
+		sort.Strings(tags)
+		counts[strings.Join(tags, ",")] = metric.Value
+	}
+	return counts
+}
+
+func TestNodeMetricsDisabled(t *testing.T) {
+	c := newNodeMetricsTestCollector(t)
+	c.NodeMetrics = false
+	c.catalogNodesFunc = nil
+	c.runTicks(1)
+	if counts := nodeCounts(c.sink.(*testSink).metrics); len(counts) > 0 {
+		t.Fatalf("unexpected node metrics %v", counts)
+	}
+}
+
+// wantNodeCounts returns the node counts of the mock catalog above.
+func wantNodeCounts() map[string]float64 {
+	want := make(map[string]float64)
+	for _, rack := range []string{"rack:a,", "rack:b,", ""} {
+		for _, status := range nodeStatuses {
+			want["datacenter:dc1,"+rack+"status:"+status] = 0
+		}
+	}
+	want["datacenter:dc1,rack:a,status:passing"] = 1
+	want["datacenter:dc1,rack:a,status:critical"] = 1
+	want["datacenter:dc1,rack:b,status:maintenance"] = 1
+	want["datacenter:dc1,rack:b,status:warning"] = 1
+	want["datacenter:dc1,status:passing"] = 1
+	return want
+}
+
+func TestNodeMetrics(t *testing.T) {
+	c := newNodeMetricsTestCollector(t)
+	c.runTicks(1)
+
+	if counts, want := nodeCounts(c.sink.(*testSink).metrics), wantNodeCounts(); !reflect.DeepEqual(counts, want) {
+		t.Fatalf("expected node counts %v, got %v", want, counts)
+	}
+}
+
+// The health checks fetched by the bulk strategy are reused rather than
+// fetched again.
+func TestNodeMetricsReuseBulkHealthState(t *testing.T) {
+	c := newNodeMetricsTestCollector(t)
+	c.Strategy = BulkStrategy
+	var requests int64
+	c.healthStateFunc = func(state string, q *consul.QueryOptions) (consul.HealthChecks, *consul.QueryMeta, error) {
+		atomic.AddInt64(&requests, 1)
+		return nodeMetricsHealthState(state, q)
+	}
+	c.runTicks(1)
+
+	if requests := atomic.LoadInt64(&requests); requests != 1 {
+		t.Fatalf("expected the health state to be fetched once, got %d requests", requests)
+	}
+	if counts, want := nodeCounts(c.sink.(*testSink).metrics), wantNodeCounts(); !reflect.DeepEqual(counts, want) {
+		t.Fatalf("expected node counts %v, got %v", want, counts)
+	}
+}
+
+// Failing to count nodes fails the collection, but the service counts are
+// still returned.
+func TestNodeMetricsError(t *testing.T) {
+	c := newNodeMetricsTestCollector(t)
+	c.catalogNodesFunc = func(q *consul.QueryOptions) ([]*consul.Node, *consul.QueryMeta, error) {
+		return nil, nil, errors.New("No cluster leader")
+	}
+
+	metrics, err := c.collect(c.pollingSource(), nil, nil)
+	if err == nil {
+		t.Fatal("expected node catalog error to be reported")
+	}
+	if len(metrics) == 0 {
+		t.Fatal("expected service counts despite the node catalog error")
+	}
+	if counts := nodeCounts(metrics); len(counts) > 0 {
+		t.Fatalf("unexpected node metrics %v", counts)
+	}
+}
@@ -0,0 +1,76 @@
+package consul2dogstats
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestCollectOnce(t *testing.T) {
+	c, err := newTestCollector(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.CollectOnce(context.Background(), false); err != nil {
+		t.Fatal(err)
+	}
+
+	client := c.sink.(*testSink)
+	client.validateMetrics(t,
+		[]string{"service:testService1"},
+		&testStatusCounts{passing: 1, warning: 0, critical: 0})
+	if failed := client.metricValues("consul2dogstats.tick.failed"); len(failed) != 1 || failed[0] != 0 {
+		t.Fatalf("unexpected failed tick counts %v", failed)
+	}
+	if held := client.metricValues("consul2dogstats.lock.held"); len(held) != 0 {
+		t.Fatalf("expected no lock to be taken, got %v", held)
+	}
+}
+
+func TestCollectOnceWithLock(t *testing.T) {
+	c, err := newTestCollector(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	locks := useTestLocks(c)
+	if err = c.CollectOnce(context.Background(), true); err != nil {
+		t.Fatal(err)
+	}
+
+	client := c.sink.(*testSink)
+	if held := client.sumMetric("consul2dogstats.lock.held", "lock:"+c.lockKey); held != 1 {
+		t.Fatalf("expected the lock to be held while collecting, got %v", held)
+	}
+	if !locks.released() {
+		t.Fatal("Consul lock was not released")
+	}
+}
+
+func TestCollectOnceFailure(t *testing.T) {
+	c, err := newTestCollector(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.catalogServicesFunc = flakyCatalogServices(-1)
+
+	err = c.CollectOnce(context.Background(), false)
+	if err == nil || !strings.Contains(err.Error(), "No cluster leader") {
+		t.Fatalf("expected collection to fail, got %v", err)
+	}
+	// The failure is still reported.
+	if failed := c.sink.(*testSink).metricValues("consul2dogstats.tick.failed"); len(failed) != 1 || failed[0] != 1 {
+		t.Fatalf("unexpected failed tick counts %v", failed)
+	}
+}
+
+func TestCollectOncePostFailure(t *testing.T) {
+	c, err := newTestCollector(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.sink = &flakySink{failCount: 1}
+
+	if err = c.CollectOnce(context.Background(), false); err == nil {
+		t.Fatal("expected failure to post metrics to be returned")
+	}
+}
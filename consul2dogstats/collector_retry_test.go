@@ -0,0 +1,176 @@
+package consul2dogstats
+
+import (
+	"errors"
+	"math/rand"
+	"testing"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+// flakyCatalogServices returns a mock of
+// https://godoc.org/github.com/hashicorp/consul/api#Catalog.Services that
+// fails the first failCount times it is called, then behaves like
+// basicCatalogServices.  A negative failCount makes it fail forever.
+func flakyCatalogServices(failCount int) func(q *consul.QueryOptions) (map[string][]string, *consul.QueryMeta, error) {
+	calls := 0
+	return func(q *consul.QueryOptions) (map[string][]string, *consul.QueryMeta, error) {
+		calls++
+		if failCount < 0 || calls <= failCount {
+			return nil, nil, errors.New("No cluster leader")
+		}
+		return basicCatalogServices(q)
+	}
+}
+
+// flakySink fails to accept the first failCount batches it is given
+// which contain service counts, and records everything else in the embedded
+// testSink.
+type flakySink struct {
+	testSink
+	failCount int
+}
+
+func (c *flakySink) Send(metrics []Metric) error {
+	for _, metric := range metrics {
+		if metric.Name == "consul.service.count" && c.failCount > 0 {
+			c.failCount--
+			return errors.New("500 Internal Server Error")
+		}
+	}
+	return c.testSink.Send(metrics)
+}
+
+// metricValues returns the values of every gauge sent for the named
+// metric, in the order they were posted.
+func (c *testSink) metricValues(name string) []float64 {
+	var values []float64
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for _, metric := range c.metrics {
+		if metric.Name != name {
+			continue
+		}
+		values = append(values, metric.Value)
+	}
+	return values
+}
+
+func TestRetryAfterConsulFailure(t *testing.T) {
+	c, err := newTestCollector(&testCollectorConfig{
+		catalogServicesFunc: flakyCatalogServices(2),
+		healthServiceFunc:   basicHealthService,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.collectInterval = 50 * time.Millisecond
+
+	// one tick and two retries
+	if err = c.runTicks(3); err != nil {
+		t.Fatal(err)
+	}
+
+	client := c.sink.(*testSink)
+	client.validateMetrics(t,
+		[]string{"service:testService1"},
+		&testStatusCounts{passing: 1, warning: 0, critical: 0})
+
+	failed := client.metricValues("consul2dogstats.tick.failed")
+	if len(failed) != 3 || failed[0] != 1 || failed[1] != 2 || failed[2] != 2 {
+		t.Fatalf("unexpected failed tick counts %v", failed)
+	}
+}
+
+func TestRetryAfterDatadogFailure(t *testing.T) {
+	c, err := newTestCollector(&basicTestCollectorConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &flakySink{failCount: 1}
+	c.sink = client
+	c.collectInterval = 50 * time.Millisecond
+
+	if err = c.runTicks(2); err != nil {
+		t.Fatal(err)
+	}
+
+	client.validateMetrics(t,
+		[]string{"service:testService1"},
+		&testStatusCounts{passing: 1, warning: 0, critical: 0})
+}
+
+func TestFailureBudgetExhausted(t *testing.T) {
+	c, err := newTestCollector(&testCollectorConfig{
+		catalogServicesFunc: flakyCatalogServices(-1),
+		healthServiceFunc:   basicHealthService,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.collectInterval = 50 * time.Millisecond
+
+	if err = c.runTicks(100); err == nil {
+		t.Fatal("expected mainLoop to give up")
+	}
+
+	client := c.sink.(*testSink)
+	if failed := client.metricValues("consul2dogstats.tick.failed"); len(failed) != c.Retry.MaxFailures {
+		t.Fatalf("expected %d failed ticks to be reported, got %v", c.Retry.MaxFailures, failed)
+	}
+	if len(client.metricValues("consul.service.count")) != 0 {
+		t.Fatal("no service counts should have been posted")
+	}
+}
+
+func TestSkippedTicksDuringBackoff(t *testing.T) {
+	c, err := newTestCollector(&testCollectorConfig{
+		catalogServicesFunc: flakyCatalogServices(1),
+		healthServiceFunc:   basicHealthService,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.collectInterval = 10 * time.Millisecond
+	c.Retry.InitialBackoff = 35 * time.Millisecond
+	c.Retry.MaxBackoff = 35 * time.Millisecond
+
+	// the retry's jitter leaves room for one or two skipped ticks before
+	// the second collection
+	c.runTicks(2)
+
+	client := c.sink.(*testSink)
+	skipped := client.metricValues("consul2dogstats.tick.skipped")
+	for _, value := range skipped {
+		if value >= 1 {
+			return
+		}
+	}
+	t.Fatalf("expected skipped ticks to be reported, got %v", skipped)
+}
+
+func TestBackoff(t *testing.T) {
+	policy := RetryPolicy{InitialBackoff: time.Second, MaxBackoff: 30 * time.Second}
+	rnd := rand.New(rand.NewSource(1))
+	for _, tc := range []struct {
+		failures int
+		max      time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{5, 16 * time.Second},
+		{6, 30 * time.Second},
+		{1000, 30 * time.Second},
+	} {
+		for i := 0; i < 100; i++ {
+			delay := policy.backoff(tc.failures, rnd)
+			if delay < tc.max/2 || delay > tc.max {
+				t.Fatalf("backoff after %d failures was %s, expected between %s and %s",
+					tc.failures, delay, tc.max/2, tc.max)
+			}
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package consul2dogstats
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// runInBackground runs c until ctx is done or Run returns of its own accord,
+// whose error is then sent on the returned channel.
+func runInBackground(ctx context.Context, c *Collector) <-chan error {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- c.Run(ctx)
+	}()
+	return errCh
+}
+
+// waitForRun waits for Run to return and returns its error.
+func waitForRun(t *testing.T, errCh <-chan error) error {
+	select {
+	case err := <-errCh:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return")
+		return nil
+	}
+}
+
+func TestRunStopsAfterMaxTicks(t *testing.T) {
+	c, err := newTestCollector(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	locks := useTestLocks(c)
+	clock := newTestClock()
+	c.clock = clock
+	c.MaxTicks = 3
+
+	errCh := runInBackground(context.Background(), c)
+	for i := 0; i < 3; i++ {
+		clock.tick(t, c.collectInterval)
+	}
+	if err := waitForRun(t, errCh); err != nil {
+		t.Fatal(err)
+	}
+
+	client := c.sink.(*testSink)
+	if failed := client.metricValues("consul2dogstats.tick.failed"); len(failed) != 3 {
+		t.Fatalf("expected 3 batches to be posted, got %d", len(failed))
+	}
+	client.validateMetrics(t,
+		[]string{"service:testService1"},
+		&testStatusCounts{passing: 3, warning: 0, critical: 0})
+	if acquired := client.sumMetric("consul2dogstats.lock.acquired", "lock:"+c.lockKey); acquired != 1 {
+		t.Fatalf("expected the lock to be acquired once, got %v", acquired)
+	}
+	if !locks.released() {
+		t.Fatal("Consul lock was not released")
+	}
+}
+
+func TestRunUntilCancelled(t *testing.T) {
+	c, err := newTestCollector(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	locks := useTestLocks(c)
+	clock := newTestClock()
+	c.clock = clock
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := runInBackground(ctx, c)
+	// Each tick is only taken once the previous collection has been posted.
+	for i := 0; i < 3; i++ {
+		clock.tick(t, c.collectInterval)
+	}
+	cancel()
+	if err := waitForRun(t, errCh); err != nil {
+		t.Fatal(err)
+	}
+
+	if failed := c.sink.(*testSink).metricValues("consul2dogstats.tick.failed"); len(failed) < 2 {
+		t.Fatalf("expected at least 2 batches to be posted, got %d", len(failed))
+	}
+	if !locks.released() {
+		t.Fatal("Consul lock was not released")
+	}
+}
+
+func TestRunRetriesOnClock(t *testing.T) {
+	c, err := newTestCollector(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := newTestClock()
+	c.clock = clock
+	c.catalogServicesFunc = flakyCatalogServices(1)
+	c.Retry = RetryPolicy{InitialBackoff: time.Minute, MaxBackoff: time.Minute, MaxFailures: 3}
+	c.MaxTicks = 2
+
+	errCh := runInBackground(context.Background(), c)
+	clock.tick(t, c.collectInterval) // fails
+	clock.tick(t, time.Second)       // skipped while backing off
+	clock.advance(time.Minute)       // retried
+	if err := waitForRun(t, errCh); err != nil {
+		t.Fatal(err)
+	}
+
+	client := c.sink.(*testSink)
+	if failed := client.metricValues("consul2dogstats.tick.failed"); !reflect.DeepEqual(failed, []float64{1, 1}) {
+		t.Fatalf("unexpected failed tick counts %v", failed)
+	}
+	if skipped := client.metricValues("consul2dogstats.tick.skipped"); !reflect.DeepEqual(skipped, []float64{0, 1}) {
+		t.Fatalf("unexpected skipped tick counts %v", skipped)
+	}
+	client.validateMetrics(t,
+		[]string{"service:testService1"},
+		&testStatusCounts{passing: 1, warning: 0, critical: 0})
+}
@@ -0,0 +1,165 @@
+package consul2dogstats
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSelfMetrics(t *testing.T) {
+	c, err := newTestCollector(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.runTicks(1)
+
+	client := c.sink.(*testSink)
+	series := len(client.metricValues("consul.service.count"))
+	if got := client.sumMetric("consul2dogstats.series.count"); got != float64(series) {
+		t.Fatalf("expected series count %d, got %v", series, got)
+	}
+	if durations := client.metricValues("consul2dogstats.tick.duration"); len(durations) != 1 || durations[0] < 0 {
+		t.Fatalf("unexpected tick durations %v", durations)
+	}
+	for _, metric := range client.metrics {
+		if metric.Name == "consul2dogstats.tick.duration" && metric.Type != HistogramType {
+			t.Fatal("expected tick duration to be a histogram")
+		}
+	}
+	for endpoint, want := range map[string]float64{
+		agentSelfEndpoint:       1,
+		catalogServicesEndpoint: 1,
+		healthServiceEndpoint:   2,
+	} {
+		if got := client.sumMetric("consul2dogstats.consul.requests", "endpoint:"+endpoint); got != want {
+			t.Fatalf("expected %v requests to %s, got %v", want, endpoint, got)
+		}
+		if got := client.sumMetric("consul2dogstats.consul.errors", "endpoint:"+endpoint); got != 0 {
+			t.Fatalf("expected no errors from %s, got %v", endpoint, got)
+		}
+	}
+}
+
+func TestSelfMetricsConsulErrors(t *testing.T) {
+	c, err := newTestCollector(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.catalogServicesFunc = flakyCatalogServices(1)
+	c.collectInterval = 50 * time.Millisecond
+
+	// one tick and one retry
+	c.runTicks(2)
+
+	client := c.sink.(*testSink)
+	if got := client.sumMetric("consul2dogstats.consul.requests", "endpoint:"+catalogServicesEndpoint); got != 2 {
+		t.Fatalf("expected 2 catalog requests, got %v", got)
+	}
+	if got := client.sumMetric("consul2dogstats.consul.errors", "endpoint:"+catalogServicesEndpoint); got != 1 {
+		t.Fatalf("expected 1 catalog error, got %v", got)
+	}
+	if got := client.sumMetric("consul2dogstats.consul.errors", "endpoint:"+healthServiceEndpoint); got != 0 {
+		t.Fatalf("expected no health errors, got %v", got)
+	}
+}
+
+func TestSelfMetricsLock(t *testing.T) {
+	c, err := newTestCollector(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := newTestClock()
+	c.clock = clock
+	c.MaxTicks = 1
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- c.Run(context.Background())
+	}()
+	clock.tick(t, c.collectInterval)
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+
+	client := c.sink.(*testSink)
+	lockTag := "lock:" + c.lockKey
+	for name, want := range map[string]float64{
+		"consul2dogstats.lock.held":     1,
+		"consul2dogstats.lock.acquired": 1,
+		"consul2dogstats.lock.lost":     0,
+	} {
+		if got := client.sumMetric(name, lockTag); got != want {
+			t.Fatalf("expected %s to be %v, got %v", name, want, got)
+		}
+	}
+
+	c.clock = realClock{}
+	c.runTicks(1)
+	if held := client.metricValues("consul2dogstats.lock.held"); held[len(held)-1] != 0 {
+		t.Fatalf("expected lock to be reported released, got %v", held)
+	}
+}
+
+// valuesByNameAndTag indexes the values of metrics by "name tag", for each
+// of their tags.
+func valuesByNameAndTag(metrics []Metric) map[string]float64 {
+	values := make(map[string]float64)
+	for _, metric := range metrics {
+		for _, tag := range metric.Tags {
+			values[metric.Name+" "+tag] = metric.Value
+		}
+	}
+	return values
+}
+
+func TestSelfStatsLockLost(t *testing.T) {
+	var s selfStats
+	s.acquired("a")
+	s.lost("a")
+	s.acquired("a")
+	s.acquired("b")
+
+	values := valuesByNameAndTag(s.metrics(time.Second, 0, nil))
+	for key, want := range map[string]float64{
+		"consul2dogstats.lock.held lock:a":     1,
+		"consul2dogstats.lock.acquired lock:a": 2,
+		"consul2dogstats.lock.lost lock:a":     1,
+		"consul2dogstats.lock.acquired lock:b": 1,
+		"consul2dogstats.lock.lost lock:b":     0,
+	} {
+		if values[key] != want {
+			t.Fatalf("expected %s to be %v, got %v", key, want, values[key])
+		}
+	}
+
+	// Counts are reset once reported, but the lock state isn't.
+	s.lost("b")
+	values = valuesByNameAndTag(s.metrics(time.Second, 0, nil))
+	for key, want := range map[string]float64{
+		"consul2dogstats.lock.held lock:a":     1,
+		"consul2dogstats.lock.acquired lock:a": 0,
+		"consul2dogstats.lock.held lock:b":     0,
+		"consul2dogstats.lock.lost lock:b":     1,
+	} {
+		if values[key] != want {
+			t.Fatalf("expected %s to be %v, got %v", key, want, values[key])
+		}
+	}
+}
+
+// In per-datacenter lock mode, the leaders of different datacenters post
+// their self metrics under different tags.
+func TestSelfTagsPerDatacenterLeader(t *testing.T) {
+	c, err := newTestCollector(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.datacenter = "dc1"
+	if tags := c.selfTags([]string{"dc2"}); !reflect.DeepEqual(tags, []string{"datacenter:dc1"}) {
+		t.Fatalf("unexpected self tags %v with a shared lock", tags)
+	}
+	c.LockMode = PerDatacenterLock
+	if tags := c.selfTags([]string{"dc2"}); !reflect.DeepEqual(tags, []string{"datacenter:dc1", "leader:dc2"}) {
+		t.Fatalf("unexpected self tags %v for the leader of dc2", tags)
+	}
+}
@@ -0,0 +1,132 @@
+package consul2dogstats
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+// This mock catalog lists three instances of a single service,
+// "testService1", whose tags follow no particular convention.
+func tagRewriteHealthService(service, tag string, passingOnly bool, q *consul.QueryOptions) ([]*consul.ServiceEntry, *consul.QueryMeta, error) {
+	var serviceEntries []*consul.ServiceEntry
+	switch service {
+	case "testService1":
+		var healthChecks []*consul.HealthCheck
+		serviceEntry1 := new(consul.ServiceEntry)
+		serviceEntry1.Service = new(consul.AgentService)
+		serviceEntry1.Service.Service = "testService1"
+		serviceEntry1.Service.Tags = []string{"Environment:Production", "v2", "team=payments", "build-3f2a9c"}
+		serviceEntry1.Checks = append(healthChecks, &consul.HealthCheck{Node: "testNode1", ServiceName: "testService1", Status: "passing"})
+		serviceEntries = append(serviceEntries, serviceEntry1)
+
+		serviceEntry2 := new(consul.ServiceEntry)
+		serviceEntry2.Service = new(consul.AgentService)
+		serviceEntry2.Service.Service = "testService1"
+		serviceEntry2.Service.Tags = []string{"environment:production", "v2", "team=payments", "build-99bc01"}
+		serviceEntry2.Checks = append(healthChecks, &consul.HealthCheck{Node: "testNode2", ServiceName: "testService1", Status: "passing"})
+		serviceEntries = append(serviceEntries, serviceEntry2)
+
+		serviceEntry3 := new(consul.ServiceEntry)
+		serviceEntry3.Service = new(consul.AgentService)
+		serviceEntry3.Service.Service = "testService1"
+		serviceEntry3.Service.Tags = []string{"environment:production", "v3", "canary", "team=payments"}
+		serviceEntry3.Checks = append(healthChecks, &consul.HealthCheck{Node: "testNode3", ServiceName: "testService1", Status: "critical"})
+		serviceEntries = append(serviceEntries, serviceEntry3)
+
+	default:
+		return nil, nil, fmt.Errorf("Unknown service %s", service)
+	}
+	return serviceEntries, nil, nil
+}
+
+var tagRewriteTestRules = []TagRule{
+	{Match: "build-*", Drop: true},
+	{Match: "/^v([0-9]+)$/", Replace: "version:$1"},
+	{Match: "/^([a-z]+)=(.*)$/", Replace: "$1:$2"},
+	{Key: "role"},
+	{Match: "team:*", Prefix: "consul_"},
+	{Lowercase: true},
+}
+
+func TestTagRewriteMetric(t *testing.T) {
+	c, err := newTestCollector(&testCollectorConfig{
+		catalogServicesFunc: multiTagCatalogServices,
+		healthServiceFunc:   tagRewriteHealthService,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.TagRewriter, err = NewTagRewriter(tagRewriteTestRules); err != nil {
+		t.Fatal(err)
+	}
+	c.runTicks(1)
+
+	tagsFound := make(map[string]bool)
+	for _, metric := range c.sink.(*testSink).metrics {
+		for _, tag := range metric.Tags {
+			tagsFound[tag] = true
+		}
+	}
+	for _, tag := range []string{"environment:production", "version:2", "version:3", "role:canary", "consul_team:payments"} {
+		if _, ok := tagsFound[tag]; !ok {
+			t.Fatalf("failed to find '%s' tag in metric", tag)
+		}
+	}
+	for tag := range tagsFound {
+		if strings.HasPrefix(tag, "build-") || tag == "v2" || tag == "canary" || tag == "Environment:Production" {
+			t.Fatalf("found unrewritten tag '%s' in metric", tag)
+		}
+	}
+
+	// The first two instances differ only in dropped and lowercased tags,
+	// so they're counted together.
+	c.sink.(*testSink).validateMetrics(t,
+		[]string{"environment:production", "version:2", "consul_team:payments"},
+		&testStatusCounts{passing: 2, warning: 0, critical: 0})
+	c.sink.(*testSink).validateMetrics(t,
+		[]string{"version:3", "role:canary"},
+		&testStatusCounts{passing: 0, warning: 0, critical: 1})
+}
+
+func TestTagRewriter(t *testing.T) {
+	var nilRewriter *TagRewriter
+	if got := nilRewriter.Rewrite([]string{"v2"}); strings.Join(got, ",") != "v2" {
+		t.Fatalf("expected nil rewriter to leave tags unchanged, got %v", got)
+	}
+
+	r, err := NewTagRewriter(tagRewriteTestRules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		tag, want string
+	}{
+		{"v2", "version:2"},
+		{"v2beta", "role:v2beta"},
+		{"Canary", "role:canary"},
+		{"team=Payments", "consul_team:payments"},
+		{"build-3f2a9c", ""},
+		{"az:us-east-1a", "az:us-east-1a"},
+	} {
+		got := strings.Join(r.Rewrite([]string{tc.tag}), ",")
+		if got != tc.want {
+			t.Fatalf("expected %q to be rewritten to %q, got %q", tc.tag, tc.want, got)
+		}
+	}
+}
+
+func TestInvalidTagRules(t *testing.T) {
+	for _, rules := range [][]TagRule{
+		{{Match: "/^v([0-9]+$/", Replace: "version:$1"}},
+		{{Match: "v*", Replace: "version"}},
+		{{Key: "a:b"}},
+		{{Match: "canary"}},
+	} {
+		if _, err := NewTagRewriter(rules); err == nil {
+			t.Fatalf("expected rules %+v to be rejected", rules)
+		}
+	}
+}
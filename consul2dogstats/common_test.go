@@ -1,11 +1,15 @@
 package consul2dogstats
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
 	"sync"
 	"testing"
+	"time"
 
 	consul "github.com/hashicorp/consul/api"
-	"github.com/zorkian/go-datadog-api"
 )
 
 type testCollectorConfig struct {
@@ -13,11 +17,18 @@ type testCollectorConfig struct {
 	catalogServicesFunc func(q *consul.QueryOptions) (map[string][]string, *consul.QueryMeta, error)
 	// Function having the same signature as https://godoc.org/github.com/hashicorp/consul/api#Health.Service
 	healthServiceFunc func(service, tag string, passingOnly bool, q *consul.QueryOptions) ([]*consul.ServiceEntry, *consul.QueryMeta, error)
+	// Function having the same signature as https://godoc.org/github.com/hashicorp/consul/api#Health.State
+	// If nil, one is derived from catalogServicesFunc and healthServiceFunc.
+	healthStateFunc func(state string, q *consul.QueryOptions) (consul.HealthChecks, *consul.QueryMeta, error)
+	// Function having the same signature as https://godoc.org/github.com/hashicorp/consul/api#Catalog.Service
+	// If nil, one is derived from healthServiceFunc.
+	catalogServiceFunc func(service, tag string, q *consul.QueryOptions) ([]*consul.CatalogService, *consul.QueryMeta, error)
 }
 
-type testDatadogClient struct {
-	// Array of metrics that we otherwise would have posted to the Datadog API endpoint
-	metrics []datadog.Metric
+type testSink struct {
+	mtx sync.Mutex
+	// Array of metrics that we otherwise would have sent to a monitoring backend
+	metrics []Metric
 }
 
 type testConsulClient struct{}
@@ -27,9 +38,14 @@ type testConsulAgent struct{}
 
 // Mocks a Consul lock
 type testConsulLock struct {
-	lockPath   string
-	mtx        *sync.Mutex
+	lockPath string
+	mtx      *sync.Mutex
+	// lockErr, if not nil, is returned by Lock.
+	lockErr error
+
+	stateMtx   sync.Mutex
 	locked     bool
+	destroyed  bool
 	lockLostCh chan struct{}
 }
 
@@ -43,7 +59,12 @@ func lockKey(lockKey string) (*testConsulLock, error) {
 
 // Lock locks the mock Consul Lock.
 func (l *testConsulLock) Lock(stopCh <-chan struct{}) (<-chan struct{}, error) {
+	if l.lockErr != nil {
+		return nil, l.lockErr
+	}
 	l.mtx.Lock()
+	l.stateMtx.Lock()
+	defer l.stateMtx.Unlock()
 	l.locked = true
 	ch := make(chan struct{})
 	l.lockLostCh = ch
@@ -52,36 +73,204 @@ func (l *testConsulLock) Lock(stopCh <-chan struct{}) (<-chan struct{}, error) {
 
 // LoseLock forces the mock Consul lock to be lost.
 func (l *testConsulLock) LoseLock() {
+	l.stateMtx.Lock()
+	defer l.stateMtx.Unlock()
 	close(l.lockLostCh)
 	return
 }
 
 // Unlock unlocks the mock Consul lock.
 func (l *testConsulLock) Unlock() error {
+	l.stateMtx.Lock()
+	defer l.stateMtx.Unlock()
+	if !l.locked {
+		return consul.ErrLockNotHeld
+	}
 	l.mtx.Unlock()
 	l.locked = false
 	return nil
 }
 
-// Destroy is a mock Consul lock method that does nothing; we provide it here
-// only to satisfy the interface.
+// Destroy records that the mock Consul lock was cleaned up.
 func (l *testConsulLock) Destroy() error {
+	l.stateMtx.Lock()
+	defer l.stateMtx.Unlock()
+	if l.locked {
+		return consul.ErrLockInUse
+	}
+	l.destroyed = true
 	return nil
 }
 
 // Locked returns true IFF the mock Consul lock is locked.
 func (l *testConsulLock) Locked() bool {
+	l.stateMtx.Lock()
+	defer l.stateMtx.Unlock()
 	return l.locked
 }
 
-// PostMetrics posts the given Metrics to our mock Datadog API client.
-func (c *testDatadogClient) PostMetrics(metrics []datadog.Metric) error {
+// Destroyed returns true IFF the mock Consul lock was cleaned up.
+func (l *testConsulLock) Destroyed() bool {
+	l.stateMtx.Lock()
+	defer l.stateMtx.Unlock()
+	return l.destroyed
+}
+
+// testLocks creates mock Consul locks, keeping every lock it has created in
+// order.
+type testLocks struct {
+	mtx     sync.Mutex
+	created []*testConsulLock
+	// failures is the number of locks, starting with the first, which fail
+	// to be acquired as if Consul were unreachable.
+	failures int
+}
+
+// useTestLocks makes c create its locks with a new testLocks, which it
+// returns.
+func useTestLocks(c *Collector) *testLocks {
+	locks := new(testLocks)
+	c.newLock = locks.newLock
+	return locks
+}
+
+func (l *testLocks) newLock(key string) (leaderLock, error) {
+	lock, err := lockKey(key)
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if len(l.created) < l.failures {
+		lock.lockErr = errors.New("No cluster leader")
+	}
+	l.created = append(l.created, lock)
+	return lock, err
+}
+
+// all returns every lock created so far.
+func (l *testLocks) all() []*testConsulLock {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	return append([]*testConsulLock(nil), l.created...)
+}
+
+// held returns the number of locks created so far, and whether the last of
+// them is held.
+func (l *testLocks) held() (int, bool) {
+	locks := l.all()
+	if len(locks) == 0 {
+		return 0, false
+	}
+	return len(locks), locks[len(locks)-1].Locked()
+}
+
+// released returns true IFF every lock acquired so far has been released
+// and cleaned up.
+func (l *testLocks) released() bool {
+	for _, lock := range l.all() {
+		if lock.lockErr == nil && (lock.Locked() || !lock.Destroyed()) {
+			return false
+		}
+	}
+	return true
+}
+
+// testSessions mocks the Consul sessions holding the mock locks, which are
+// all held by testSession until another session takes over.
+type testSessions struct {
+	mtx     sync.Mutex
+	stolen  bool
+	expired bool
+}
+
+const testSession = "test-session"
+
+// useTestSessions makes c look up lock holders and sessions in a new
+// testSessions, which it returns.
+func useTestSessions(c *Collector) *testSessions {
+	sessions := new(testSessions)
+	c.kvGetFunc = sessions.kvGet
+	c.sessionInfoFunc = sessions.info
+	return sessions
+}
+
+// steal makes another session take over every lock.
+func (s *testSessions) steal() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.stolen = true
+}
+
+// expire makes testSession expire.
+func (s *testSessions) expire() {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.expired = true
+}
+
+// kvGet mocks https://godoc.org/github.com/hashicorp/consul/api#KV.Get
+func (s *testSessions) kvGet(key string, q *consul.QueryOptions) (*consul.KVPair, *consul.QueryMeta, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	pair := &consul.KVPair{Key: key, Session: testSession}
+	if s.stolen {
+		pair.Session = "other-session"
+	}
+	return pair, &consul.QueryMeta{}, nil
+}
+
+// info mocks https://godoc.org/github.com/hashicorp/consul/api#Session.Info
+func (s *testSessions) info(id string, q *consul.QueryOptions) (*consul.SessionEntry, *consul.QueryMeta, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.expired && id == testSession {
+		return nil, &consul.QueryMeta{}, nil
+	}
+	return &consul.SessionEntry{ID: id}, &consul.QueryMeta{}, nil
+}
+
+// Send records the given metrics in our mock sink.
+func (c *testSink) Send(metrics []Metric) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
 	for _, metric := range metrics {
 		c.metrics = append(c.metrics, metric)
 	}
 	return nil
 }
 
+// runTicks runs the main loop of c until it has made n collections.
+func (c *Collector) runTicks(n int) error {
+	c.MaxTicks = n
+	return c.mainLoop(context.Background(), nil, nil)
+}
+
+// startCollector runs c in the background.  The returned function stops it,
+// waits for Run to return and returns its error.
+func startCollector(c *Collector) (stop func() error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- c.Run(ctx)
+	}()
+	return func() error {
+		cancel()
+		return <-errCh
+	}
+}
+
+// startMainLoop runs the main loop of c in the background until the returned
+// function is called.
+func startMainLoop(c *Collector) (stop func() error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- c.mainLoop(ctx, nil, nil)
+	}()
+	return func() error {
+		cancel()
+		return <-errCh
+	}
+}
+
 // basicAgentSelf mocks https://godoc.org/github.com/hashicorp/consul/api#Agent.Self
 func basicAgentSelf() (map[string]map[string]interface{}, error) {
 	info := make(map[string]map[string]interface{})
@@ -90,12 +279,18 @@ func basicAgentSelf() (map[string]map[string]interface{}, error) {
 	return info, nil
 }
 
+// basicCatalogDatacenters mocks https://godoc.org/github.com/hashicorp/consul/api#Catalog.Datacenters
+func basicCatalogDatacenters() ([]string, error) {
+	return []string{"dc1"}, nil
+}
+
 // newTestCollector returns a mock Collector object.  If provided a
 // pointer to a testCollectorConfig, the mocked Consul functions in it will
 // be called to collect the data, and posted to our mock Datadog client.
 func newTestCollector(cfg *testCollectorConfig) (*Collector, error) {
 	c := new(Collector)
 	c.agentSelfFunc = basicAgentSelf
+	c.catalogDatacentersFunc = basicCatalogDatacenters
 
 	if cfg == nil {
 		c.healthServiceFunc = basicHealthService
@@ -104,15 +299,125 @@ func newTestCollector(cfg *testCollectorConfig) (*Collector, error) {
 		c.healthServiceFunc = cfg.healthServiceFunc
 		c.catalogServicesFunc = cfg.catalogServicesFunc
 	}
+	if cfg != nil && cfg.healthStateFunc != nil {
+		c.healthStateFunc = cfg.healthStateFunc
+	} else {
+		c.healthStateFunc = derivedHealthState(c.catalogServicesFunc, c.healthServiceFunc)
+	}
+	if cfg != nil && cfg.catalogServiceFunc != nil {
+		c.catalogServiceFunc = cfg.catalogServiceFunc
+	} else {
+		c.catalogServiceFunc = derivedCatalogService(c.healthServiceFunc)
+	}
 
-	c.datadogClient = new(testDatadogClient)
+	c.sink = new(testSink)
+	c.clock = realClock{}
 	c.collectInterval = 1
 	c.lockKey = "consul2dogstats/test_lock"
-	c.lock, _ = lockKey(c.lockKey)
+	useTestLocks(c)
+	useTestSessions(c)
+	c.election = ConsulElection
+	c.Fencing = SuppressFencing
+	c.LockMode = SharedLock
+	c.Strategy = PerServiceStrategy
+	c.Concurrency = 4
+	c.RequestTimeout = time.Second
+	c.Retry = RetryPolicy{InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond, MaxFailures: 3}
+	c.rand = rand.New(rand.NewSource(1))
 
 	return c, nil
 }
 
+// derivedHealthState mocks https://godoc.org/github.com/hashicorp/consul/api#Health.State
+// by querying the given mock catalog and service health functions, so that
+// every mock catalog can be used with the bulk health strategy.  Checks with
+// a CheckID but no ServiceName are treated as node checks.
+func derivedHealthState(
+	catalogServicesFunc func(q *consul.QueryOptions) (map[string][]string, *consul.QueryMeta, error),
+	healthServiceFunc func(service, tag string, passingOnly bool, q *consul.QueryOptions) ([]*consul.ServiceEntry, *consul.QueryMeta, error),
+) func(state string, q *consul.QueryOptions) (consul.HealthChecks, *consul.QueryMeta, error) {
+	return func(state string, q *consul.QueryOptions) (consul.HealthChecks, *consul.QueryMeta, error) {
+		services, _, err := catalogServicesFunc(q)
+		if err != nil {
+			return nil, nil, err
+		}
+		var checks consul.HealthChecks
+		seenNodeChecks := make(map[string]bool)
+		for serviceName := range services {
+			entries, _, err := healthServiceFunc(serviceName, "", false, q)
+			if err != nil {
+				return nil, nil, err
+			}
+			for i, entry := range entries {
+				node := fmt.Sprintf("%s-%d", serviceName, i)
+				if entry.Node != nil {
+					node = entry.Node.Node
+				} else if len(entry.Checks) > 0 && entry.Checks[0].Node != "" {
+					node = entry.Checks[0].Node
+				}
+				serviceID := entry.Service.ID
+				if serviceID == "" {
+					serviceID = fmt.Sprintf("%s-%d", serviceName, i)
+				}
+				for _, check := range entry.Checks {
+					check := *check
+					check.Node = node
+					if check.CheckID != "" && check.ServiceName == "" {
+						// node check, shared by every instance on the node
+						if seenNodeChecks[node+"/"+check.CheckID] {
+							continue
+						}
+						seenNodeChecks[node+"/"+check.CheckID] = true
+					} else {
+						check.ServiceID = serviceID
+						check.ServiceName = serviceName
+						check.ServiceTags = entry.Service.Tags
+					}
+					if state == consul.HealthAny || state == check.Status {
+						checks = append(checks, &check)
+					}
+				}
+			}
+		}
+		return checks, nil, nil
+	}
+}
+
+// derivedCatalogService mocks https://godoc.org/github.com/hashicorp/consul/api#Catalog.Service
+// by querying the given mock service health function, naming nodes and
+// service instances missing from it as derivedHealthState does.
+func derivedCatalogService(
+	healthServiceFunc func(service, tag string, passingOnly bool, q *consul.QueryOptions) ([]*consul.ServiceEntry, *consul.QueryMeta, error),
+) func(service, tag string, q *consul.QueryOptions) ([]*consul.CatalogService, *consul.QueryMeta, error) {
+	return func(service, tag string, q *consul.QueryOptions) ([]*consul.CatalogService, *consul.QueryMeta, error) {
+		entries, _, err := healthServiceFunc(service, tag, false, q)
+		if err != nil {
+			return nil, nil, err
+		}
+		var instances []*consul.CatalogService
+		for i, entry := range entries {
+			instance := &consul.CatalogService{
+				Node:        fmt.Sprintf("%s-%d", service, i),
+				ServiceID:   entry.Service.ID,
+				ServiceName: service,
+				ServiceTags: entry.Service.Tags,
+				ServiceMeta: entry.Service.Meta,
+			}
+			if entry.Node != nil {
+				instance.Node = entry.Node.Node
+				instance.NodeMeta = entry.Node.Meta
+			} else if len(entry.Checks) > 0 && entry.Checks[0].Node != "" {
+				instance.Node = entry.Checks[0].Node
+			}
+			if instance.ServiceID == "" {
+				instance.ServiceID = fmt.Sprintf("%s-%d", service, i)
+			}
+			instances = append(instances, instance)
+		}
+		return instances, nil, nil
+	}
+}
+
 // stringInSlice finds the needle string in the haystack array.
 func stringInSlice(needle string, haystack []string) bool {
 	for _, elem := range haystack {
@@ -132,12 +437,15 @@ type testStatusCounts struct {
 // and that have been posted to the mock Datadog client, match the counts provided.
 // The counts are expressed in terms of a testStatusCounts struct, the pointer to
 // which must be provided as well.
-func (c *testDatadogClient) validateMetrics(t *testing.T,
+func (c *testSink) validateMetrics(t *testing.T,
 	tags []string, // all tags must match
 	wanted *testStatusCounts) {
 
 	var passingCount, warningCount, criticalCount int
 
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
 	for _, metric := range c.metrics {
 		var allTagsPresent = true
 		for _, tag := range tags {
@@ -149,19 +457,13 @@ func (c *testDatadogClient) validateMetrics(t *testing.T,
 			continue
 		}
 		if stringInSlice("status:passing", metric.Tags) {
-			for _, point := range metric.Points {
-				passingCount += int(point[1])
-			}
+			passingCount += int(metric.Value)
 		}
 		if stringInSlice("status:warning", metric.Tags) {
-			for _, point := range metric.Points {
-				warningCount += int(point[1])
-			}
+			warningCount += int(metric.Value)
 		}
 		if stringInSlice("status:critical", metric.Tags) {
-			for _, point := range metric.Points {
-				criticalCount += int(point[1])
-			}
+			criticalCount += int(metric.Value)
 		}
 	}
 	if passingCount != wanted.passing {
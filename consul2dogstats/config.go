@@ -0,0 +1,398 @@
+package consul2dogstats
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Names of the supported metric sinks.
+const (
+	APISink        = "api"
+	DogStatsdSink  = "dogstatsd"
+	PrometheusSink = "prometheus"
+)
+
+// Config is the complete configuration of consul2dogstats.  Each setting can
+// be given in a JSON configuration file under the key in its json tag, and
+// overridden by the environment variable in its env tag.
+type Config struct {
+	LeaderElection  LeaderElection `json:"leader_election" env:"C2D_LEADER_ELECTION"`
+	LockPath        string         `json:"lock_path" env:"C2D_LOCK_PATH"`
+	LockFile        string         `json:"lock_file" env:"C2D_LOCK_FILE"`
+	CollectInterval time.Duration  `json:"collect_interval" env:"C2D_COLLECT_INTERVAL"`
+
+	LockSessionTTL     time.Duration `json:"lock_session_ttl" env:"C2D_LOCK_SESSION_TTL"`
+	LockWaitTime       time.Duration `json:"lock_wait_time" env:"C2D_LOCK_WAIT_TIME"`
+	LockMonitorRetries int           `json:"lock_monitor_retries" env:"C2D_LOCK_MONITOR_RETRIES"`
+	LockSessionName    string        `json:"lock_session_name" env:"C2D_LOCK_SESSION_NAME"`
+	Fencing            FencingMode   `json:"fencing" env:"C2D_FENCING"`
+
+	Sink          string        `json:"sink" env:"C2D_SINK"`
+	SinkTimeout   time.Duration `json:"sink_timeout" env:"C2D_SINK_TIMEOUT"`
+	DatadogAPIKey string        `json:"datadog_api_key" env:"DATADOG_API_KEY"`
+	StatsdAddr    string        `json:"statsd_addr" env:"STATSD_ADDR"`
+
+	PrometheusAddr string `json:"prometheus_addr" env:"C2D_PROMETHEUS_ADDR"`
+	StatusAddr     string `json:"status_addr" env:"C2D_STATUS_ADDR"`
+
+	Datacenters []string `json:"datacenters" env:"C2D_DATACENTERS"`
+	LockMode    LockMode `json:"lock_mode" env:"C2D_LOCK_MODE"`
+	MemberID    string   `json:"member_id" env:"C2D_MEMBER_ID"`
+
+	HealthStrategy HealthStrategy `json:"health_strategy" env:"C2D_HEALTH_STRATEGY"`
+	Concurrency    int            `json:"concurrency" env:"C2D_CONCURRENCY"`
+	RequestTimeout time.Duration  `json:"request_timeout" env:"C2D_REQUEST_TIMEOUT"`
+	Watch          bool           `json:"watch" env:"C2D_WATCH"`
+
+	CheckMetrics         bool `json:"check_metrics" env:"C2D_CHECK_METRICS"`
+	NodeMetrics          bool `json:"node_metrics" env:"C2D_NODE_METRICS"`
+	ExcludeNodeChecks    bool `json:"exclude_node_checks" env:"C2D_EXCLUDE_NODE_CHECKS"`
+	MaintenanceReasonTag bool `json:"maintenance_reason_tag" env:"C2D_MAINTENANCE_REASON_TAG"`
+
+	ServiceInclude []string  `json:"service_include" env:"C2D_SERVICE_INCLUDE"`
+	ServiceExclude []string  `json:"service_exclude" env:"C2D_SERVICE_EXCLUDE"`
+	TagInclude     []string  `json:"tag_include" env:"C2D_TAG_INCLUDE"`
+	TagExclude     []string  `json:"tag_exclude" env:"C2D_TAG_EXCLUDE"`
+	TagRules       []TagRule `json:"tag_rules"`
+
+	ServiceMetaTags []string `json:"service_meta_tags" env:"C2D_SERVICE_META_TAGS"`
+	NodeMetaTags    []string `json:"node_meta_tags" env:"C2D_NODE_META_TAGS"`
+
+	RetryInitialBackoff time.Duration `json:"retry_initial_backoff" env:"C2D_RETRY_INITIAL_BACKOFF"`
+	RetryMaxBackoff     time.Duration `json:"retry_max_backoff" env:"C2D_RETRY_MAX_BACKOFF"`
+	MaxFailures         int           `json:"max_failures" env:"C2D_MAX_FAILURES"`
+}
+
+// DefaultConfig returns the configuration used when neither a configuration
+// file nor environment variables say otherwise.
+func DefaultConfig() *Config {
+	return &Config{
+		LeaderElection:      ConsulElection,
+		LockPath:            "consul2dogstats/.lock",
+		CollectInterval:     10 * time.Second,
+		LockSessionTTL:      DefaultLockOptions.SessionTTL,
+		LockWaitTime:        DefaultLockOptions.WaitTime,
+		LockMonitorRetries:  DefaultLockOptions.MonitorRetries,
+		LockSessionName:     DefaultLockOptions.SessionName,
+		Fencing:             SuppressFencing,
+		Sink:                APISink,
+		SinkTimeout:         defaultSinkTimeout,
+		StatsdAddr:          "127.0.0.1:8125",
+		PrometheusAddr:      ":9273",
+		LockMode:            SharedLock,
+		HealthStrategy:      PerServiceStrategy,
+		Concurrency:         defaultConcurrency,
+		RequestTimeout:      defaultRequestTimeout,
+		RetryInitialBackoff: DefaultRetryPolicy.InitialBackoff,
+		RetryMaxBackoff:     DefaultRetryPolicy.MaxBackoff,
+		MaxFailures:         DefaultRetryPolicy.MaxFailures,
+	}
+}
+
+// ConfigErrors lists every problem found while loading or validating a
+// Config.
+type ConfigErrors []string
+
+func (e ConfigErrors) Error() string {
+	return strings.Join(e, "; ")
+}
+
+// LoadConfig returns the default configuration, updated from the JSON
+// configuration file at path (if not empty) and then from the environment,
+// and validated.  All the problems found are returned together as
+// ConfigErrors.
+func LoadConfig(path string, getenv func(string) string) (*Config, error) {
+	return loadConfig(path, getenv, true)
+}
+
+// LoadDryRunConfig is like LoadConfig, but for a dry run, whose metrics are
+// printed instead of being sent to the configured sinks: the sink settings
+// aren't validated.
+func LoadDryRunConfig(path string, getenv func(string) string) (*Config, error) {
+	return loadConfig(path, getenv, false)
+}
+
+func loadConfig(path string, getenv func(string) string, validateSinks bool) (*Config, error) {
+	var errs ConfigErrors
+	c := DefaultConfig()
+	if path != "" {
+		if err := c.LoadFile(path); err != nil {
+			errs = appendConfigErrors(errs, err)
+		}
+	}
+	if err := c.LoadEnv(getenv); err != nil {
+		errs = appendConfigErrors(errs, err)
+	}
+	if err := c.validate(validateSinks); err != nil {
+		errs = appendConfigErrors(errs, err)
+	}
+	if len(errs) > 0 {
+		return c, errs
+	}
+	return c, nil
+}
+
+// LoadFile updates c from the JSON configuration file at path.  Settings
+// missing from the file are left unchanged.  Unknown settings are errors.
+func (c *Config) LoadFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ConfigErrors{err.Error()}
+	}
+	var settings map[string]json.RawMessage
+	if err = json.Unmarshal(data, &settings); err != nil {
+		return ConfigErrors{fmt.Sprintf("%s: %s", path, err)}
+	}
+
+	fields := c.fields("json")
+	keys := make([]string, 0, len(settings))
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var errs ConfigErrors
+	for _, key := range keys {
+		field, ok := fields[key]
+		if !ok {
+			errs = append(errs, fmt.Sprintf("%s: unknown setting %q", path, key))
+			continue
+		}
+		if err = setFromJSON(field, settings[key]); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s: %s", path, key, err))
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// LoadEnv updates c from those environment variables that are set, as
+// returned by getenv.
+func (c *Config) LoadEnv(getenv func(string) string) error {
+	fields := c.fields("env")
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs ConfigErrors
+	for _, name := range names {
+		s := getenv(name)
+		if s == "" {
+			continue
+		}
+		if err := setFromString(fields[name], s); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Validate checks that c is a usable configuration.
+func (c *Config) Validate() error {
+	return c.validate(true)
+}
+
+// validate checks that c is a usable configuration, including the settings
+// of the sinks it lists if validateSinks is true.
+func (c *Config) validate(validateSinks bool) error {
+	var errs ConfigErrors
+	if c.LockPath == "" {
+		errs = append(errs, "lock_path must not be empty")
+	}
+	if c.CollectInterval <= 0 {
+		errs = append(errs, "collect_interval must be positive")
+	}
+	if _, err := ParseLeaderElection(string(c.LeaderElection)); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if c.LeaderElection == FileElection {
+		if !fileLocksSupported {
+			errs = append(errs, fmt.Sprintf("leader_election %q is not supported on %s", FileElection, runtime.GOOS))
+		}
+		if c.LockFile == "" {
+			errs = append(errs, fmt.Sprintf("lock_file must not be empty when leader_election is %q", FileElection))
+		}
+	}
+	if c.LockSessionTTL < minLockSessionTTL || c.LockSessionTTL > maxLockSessionTTL {
+		errs = append(errs, fmt.Sprintf("lock_session_ttl must be between %s and %s", minLockSessionTTL, maxLockSessionTTL))
+	}
+	if c.LockWaitTime <= 0 {
+		errs = append(errs, "lock_wait_time must be positive")
+	}
+	if c.LockMonitorRetries < 0 {
+		errs = append(errs, "lock_monitor_retries must not be negative")
+	}
+	if _, err := ParseFencingMode(string(c.Fencing)); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if validateSinks {
+		if len(c.Sinks()) == 0 {
+			errs = append(errs, "sink must name at least one sink")
+		}
+		for _, sink := range c.Sinks() {
+			switch sink {
+			case APISink:
+				if c.DatadogAPIKey == "" {
+					errs = append(errs, "DATADOG_API_KEY environment variable must be set, or datadog_api_key in the configuration file, when sink is \"api\"")
+				}
+			case DogStatsdSink:
+				if c.StatsdAddr == "" {
+					errs = append(errs, "statsd_addr must not be empty when sink is \"dogstatsd\"")
+				}
+			case PrometheusSink:
+				if c.PrometheusAddr == "" {
+					errs = append(errs, "prometheus_addr must not be empty when sink is \"prometheus\"")
+				}
+			default:
+				errs = append(errs, fmt.Sprintf("unknown sink %q; must be one of %q, %q or %q",
+					sink, APISink, DogStatsdSink, PrometheusSink))
+			}
+		}
+	}
+	if c.SinkTimeout < 0 {
+		errs = append(errs, "sink_timeout must not be negative")
+	}
+	for _, datacenter := range c.Datacenters {
+		if datacenter == "" {
+			errs = append(errs, "datacenters must not include an empty name")
+			break
+		}
+	}
+	if _, err := ParseLockMode(string(c.LockMode)); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if c.LockMode == ShardedLock && c.LeaderElection != ConsulElection {
+		errs = append(errs, fmt.Sprintf("lock_mode %q requires leader_election %q", ShardedLock, ConsulElection))
+	}
+	if c.LockMode == ShardedLock && c.Watch {
+		errs = append(errs, fmt.Sprintf("lock_mode %q doesn't support watch mode", ShardedLock))
+	}
+	if _, err := ParseHealthStrategy(string(c.HealthStrategy)); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if _, err := NewFilter(c.ServiceInclude, c.ServiceExclude); err != nil {
+		errs = append(errs, "service filter: "+err.Error())
+	}
+	if _, err := NewFilter(c.TagInclude, c.TagExclude); err != nil {
+		errs = append(errs, "tag filter: "+err.Error())
+	}
+	if _, err := NewTagRewriter(c.TagRules); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if c.Concurrency < 1 {
+		errs = append(errs, "concurrency must be at least 1")
+	}
+	if c.RequestTimeout < 0 {
+		errs = append(errs, "request_timeout must not be negative")
+	}
+	if c.RetryInitialBackoff < 0 || c.RetryMaxBackoff < 0 {
+		errs = append(errs, "retry backoffs must not be negative")
+	}
+	if c.MaxFailures < 0 {
+		errs = append(errs, "max_failures must not be negative")
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Sinks returns the names of the sinks listed, comma-separated, in c.Sink.
+func (c *Config) Sinks() []string {
+	var sinks []string
+	for _, sink := range strings.Split(c.Sink, ",") {
+		if sink = strings.TrimSpace(sink); sink != "" {
+			sinks = append(sinks, sink)
+		}
+	}
+	return sinks
+}
+
+// fields returns the settings of c keyed by the given struct tag.
+func (c *Config) fields(tag string) map[string]reflect.Value {
+	fields := make(map[string]reflect.Value)
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if name := v.Type().Field(i).Tag.Get(tag); name != "" {
+			fields[name] = v.Field(i)
+		}
+	}
+	return fields
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// setFromString sets a setting from its string form, as used in the
+// environment: durations as Go duration strings and lists comma-separated.
+func setFromString(field reflect.Value, s string) error {
+	if field.Type() == durationType {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+		return nil
+	}
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(n))
+	case reflect.Slice:
+		var list []string
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		field.Set(reflect.ValueOf(list))
+	default:
+		return fmt.Errorf("unsupported setting type %s", field.Type())
+	}
+	return nil
+}
+
+// setFromJSON sets a setting from its JSON form.  Durations are given as Go
+// duration strings.
+func setFromJSON(field reflect.Value, data json.RawMessage) error {
+	if field.Type() == durationType {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return fmt.Errorf("expected a duration string such as \"10s\"")
+		}
+		return setFromString(field, s)
+	}
+	return json.Unmarshal(data, field.Addr().Interface())
+}
+
+// appendConfigErrors appends the problems described by err to errs.
+func appendConfigErrors(errs ConfigErrors, err error) ConfigErrors {
+	if e, ok := err.(ConfigErrors); ok {
+		return append(errs, e...)
+	}
+	return append(errs, err.Error())
+}
@@ -0,0 +1,215 @@
+package consul2dogstats
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestConfig writes a configuration file, returning its path.
+func writeTestConfig(t *testing.T, contents string) string {
+	f, err := ioutil.TempFile("", "consul2dogstats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err = f.WriteString(contents); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+// testEnv returns a getenv function looking up the given variables.
+func testEnv(vars map[string]string) func(string) string {
+	return func(name string) string {
+		return vars[name]
+	}
+}
+
+func TestDefaultConfigIsValidWithAPIKey(t *testing.T) {
+	c := DefaultConfig()
+	c.DatadogAPIKey = "key"
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	path := writeTestConfig(t, `{
+		"lock_path": "c2d/lock",
+		"collect_interval": "30s",
+		"lock_session_ttl": "1m",
+		"lock_monitor_retries": 5,
+		"lock_session_name": "c2d",
+		"sink": "dogstatsd",
+		"statsd_addr": "unix:///var/run/datadog/dsd.socket",
+		"datacenters": ["dc1", "dc2"],
+		"lock_mode": "per-datacenter",
+		"health_strategy": "bulk",
+		"concurrency": 16,
+		"watch": true,
+		"check_metrics": true,
+		"node_metrics": true,
+		"tag_rules": [{"match": "/^v([0-9]+)$/", "replace": "version:$1"}, {"key": "role"}],
+		"max_failures": 0
+	}`)
+	defer os.Remove(path)
+
+	c, err := LoadConfig(path, testEnv(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := DefaultConfig()
+	want.LockPath = "c2d/lock"
+	want.CollectInterval = 30 * time.Second
+	want.LockSessionTTL = time.Minute
+	want.LockMonitorRetries = 5
+	want.LockSessionName = "c2d"
+	want.Sink = DogStatsdSink
+	want.StatsdAddr = "unix:///var/run/datadog/dsd.socket"
+	want.Datacenters = []string{"dc1", "dc2"}
+	want.LockMode = PerDatacenterLock
+	want.HealthStrategy = BulkStrategy
+	want.Concurrency = 16
+	want.Watch = true
+	want.CheckMetrics = true
+	want.NodeMetrics = true
+	want.TagRules = []TagRule{{Match: "/^v([0-9]+)$/", Replace: "version:$1"}, {Key: "role"}}
+	want.MaxFailures = 0
+	if !reflect.DeepEqual(c, want) {
+		t.Fatalf("expected %+v, got %+v", want, c)
+	}
+}
+
+func TestEnvOverridesConfigFile(t *testing.T) {
+	path := writeTestConfig(t, `{"sink": "dogstatsd", "collect_interval": "30s", "concurrency": 16}`)
+	defer os.Remove(path)
+
+	c, err := LoadConfig(path, testEnv(map[string]string{
+		"C2D_COLLECT_INTERVAL": "1m",
+		"C2D_DATACENTERS":      "dc1, dc3,",
+		"C2D_WATCH":            "true",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.CollectInterval != time.Minute {
+		t.Fatalf("expected environment to override collect interval, got %s", c.CollectInterval)
+	}
+	if c.Concurrency != 16 {
+		t.Fatalf("expected concurrency from file, got %d", c.Concurrency)
+	}
+	if strings.Join(c.Datacenters, ",") != "dc1,dc3" || !c.Watch {
+		t.Fatalf("unexpected configuration %+v", c)
+	}
+}
+
+// Every problem should be reported, not just the first.
+func TestConfigReportsAllErrors(t *testing.T) {
+	path := writeTestConfig(t, `{
+		"collect_interval": 10,
+		"sink": "carrier-pigeon",
+		"concurrency": "lots",
+		"lock_mode": "exclusive",
+		"colect_interval": "10s"
+	}`)
+	defer os.Remove(path)
+
+	_, err := LoadConfig(path, testEnv(map[string]string{
+		"C2D_REQUEST_TIMEOUT":  "forever",
+		"C2D_WATCH":            "sometimes",
+		"C2D_SERVICE_EXCLUDE":  "/build-[/",
+		"C2D_LOCK_SESSION_TTL": "5s",
+	}))
+	errs, ok := err.(ConfigErrors)
+	if !ok {
+		t.Fatalf("expected ConfigErrors, got %v", err)
+	}
+	for _, want := range []string{
+		"collect_interval: expected a duration",
+		`unknown setting "colect_interval"`,
+		"concurrency: json: cannot unmarshal",
+		"C2D_REQUEST_TIMEOUT",
+		"C2D_WATCH",
+		`unknown sink "carrier-pigeon"`,
+		`unknown lock mode "exclusive"`,
+		`service filter: invalid pattern "/build-[/"`,
+		"lock_session_ttl must be between 10s and 24h0m0s",
+	} {
+		if !strings.Contains(errs.Error(), want) {
+			t.Fatalf("expected errors to include %q, got:\n%s", want, strings.Join(errs, "\n"))
+		}
+	}
+}
+
+func TestFileElectionRequiresLockFile(t *testing.T) {
+	_, err := LoadConfig("", testEnv(map[string]string{
+		"DATADOG_API_KEY":     "key",
+		"C2D_LEADER_ELECTION": "file",
+	}))
+	if err == nil || !strings.Contains(err.Error(), "lock_file must not be empty") {
+		t.Fatalf("expected missing lock file to be reported, got %v", err)
+	}
+}
+
+func TestShardedLockRequiresConsulElection(t *testing.T) {
+	_, err := LoadConfig("", testEnv(map[string]string{
+		"DATADOG_API_KEY":     "key",
+		"C2D_LOCK_MODE":       "sharded",
+		"C2D_LEADER_ELECTION": "none",
+	}))
+	if err == nil || !strings.Contains(err.Error(), `lock_mode "sharded" requires leader_election "consul"`) {
+		t.Fatalf("expected sharding without Consul to be reported, got %v", err)
+	}
+	c, err := LoadConfig("", testEnv(map[string]string{
+		"DATADOG_API_KEY": "key",
+		"C2D_LOCK_MODE":   "sharded",
+		"C2D_MEMBER_ID":   "collector-1",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.LockMode != ShardedLock || c.MemberID != "collector-1" {
+		t.Fatalf("unexpected configuration %+v", c)
+	}
+}
+
+func TestShardedLockRejectsWatch(t *testing.T) {
+	_, err := LoadConfig("", testEnv(map[string]string{
+		"DATADOG_API_KEY": "key",
+		"C2D_LOCK_MODE":   "sharded",
+		"C2D_WATCH":       "true",
+	}))
+	if err == nil || !strings.Contains(err.Error(), `lock_mode "sharded" doesn't support watch mode`) {
+		t.Fatalf("expected sharded watch mode to be reported, got %v", err)
+	}
+}
+
+func TestConfigFileNotFound(t *testing.T) {
+	if _, err := LoadConfig("/nonexistent/consul2dogstats.json", testEnv(nil)); err == nil {
+		t.Fatal("expected missing configuration file to be reported")
+	}
+}
+
+func TestAPISinkRequiresKey(t *testing.T) {
+	if _, err := LoadConfig("", testEnv(nil)); err == nil || !strings.Contains(err.Error(), "DATADOG_API_KEY") {
+		t.Fatalf("expected missing API key to be reported, got %v", err)
+	}
+	if _, err := LoadConfig("", testEnv(map[string]string{"DATADOG_API_KEY": "key"})); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// The metrics of a dry run are printed rather than sent, so the settings of
+// the configured sinks aren't required.
+func TestDryRunConfigSkipsSinks(t *testing.T) {
+	if _, err := LoadDryRunConfig("", testEnv(nil)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadDryRunConfig("", testEnv(map[string]string{"C2D_CONCURRENCY": "0"})); err == nil {
+		t.Fatal("expected other settings to be validated")
+	}
+}
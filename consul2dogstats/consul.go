@@ -1,7 +1,56 @@
 package consul2dogstats
 
-type consulLock interface {
-	Lock(stopCh <-chan struct{}) (<-chan struct{}, error)
-	Unlock() error
-	Destroy() error
+import (
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+// lockRetryInterval is how long to wait before trying again after failing
+// to acquire a lock, for instance because Consul was unreachable.
+const lockRetryInterval = consul.DefaultLockRetryTime
+
+// The range of session TTLs accepted by Consul.
+const (
+	minLockSessionTTL = 10 * time.Second
+	maxLockSessionTTL = 24 * time.Hour
+)
+
+// LockOptions controls the Consul sessions backing the collector's locks.
+// Zero values mean Consul's defaults.
+type LockOptions struct {
+	// SessionTTL is how long a lock survives without its session being
+	// renewed, for instance after the collector holding it has died.
+	SessionTTL time.Duration
+	// WaitTime is how long each blocking query for the lock waits before
+	// being retried.  It bounds how long it takes to give up waiting.
+	WaitTime time.Duration
+	// MonitorRetries is how many consecutive errors from Consul are
+	// tolerated while monitoring a held lock, so that the lock isn't given
+	// up during a brief Consul outage.
+	MonitorRetries int
+	// SessionName is the name of the sessions, as shown by Consul.
+	SessionName string
+}
+
+// DefaultLockOptions are the LockOptions of the default configuration.
+var DefaultLockOptions = LockOptions{
+	SessionTTL:     15 * time.Second,
+	WaitTime:       consul.DefaultLockWaitTime,
+	MonitorRetries: 3,
+	SessionName:    "consul2dogstats",
+}
+
+// consulLockOptions returns the options of a Consul lock at key.
+func (o LockOptions) consulLockOptions(key string) *consul.LockOptions {
+	opts := &consul.LockOptions{
+		Key:            key,
+		SessionName:    o.SessionName,
+		MonitorRetries: o.MonitorRetries,
+		LockWaitTime:   o.WaitTime,
+	}
+	if o.SessionTTL > 0 {
+		opts.SessionTTL = o.SessionTTL.String()
+	}
+	return opts
 }
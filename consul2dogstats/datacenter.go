@@ -0,0 +1,91 @@
+package consul2dogstats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// AllDatacenters may be listed in Collector.Datacenters to collect from
+// every datacenter known to the local Consul agent.
+const AllDatacenters = "*"
+
+// LockMode selects how collectors covering several datacenters coordinate.
+type LockMode string
+
+const (
+	// SharedLock elects a single collector to collect from every datacenter.
+	SharedLock LockMode = "shared"
+	// PerDatacenterLock holds a separate lock for each datacenter, beneath
+	// the configured lock key, so that the datacenters can be spread across
+	// several collectors.
+	PerDatacenterLock LockMode = "per-datacenter"
+	// ShardedLock spreads the services of every datacenter across all the
+	// collectors, each of which holds a lock of its own, beneath the
+	// configured lock key, for as long as it's running.
+	ShardedLock LockMode = "sharded"
+)
+
+// ParseLockMode returns the LockMode with the given name.
+func ParseLockMode(name string) (LockMode, error) {
+	switch mode := LockMode(name); mode {
+	case SharedLock, PerDatacenterLock, ShardedLock:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown lock mode %q; must be one of %q, %q or %q",
+		name, SharedLock, PerDatacenterLock, ShardedLock)
+}
+
+// localDatacenter returns the datacenter of the Consul agent we're talking
+// to.
+func (c *Collector) localDatacenter(stopCh <-chan struct{}) (string, error) {
+	if c.datacenter != "" {
+		return c.datacenter, nil
+	}
+
+	var agentInfo map[string]map[string]interface{}
+	err := c.call(stopCh, agentSelfEndpoint, "agent info", func(context.Context) (err error) {
+		agentInfo, err = c.agentSelfFunc()
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	datacenter, ok := agentInfo["Config"]["Datacenter"].(string)
+	if !ok {
+		return "", errors.New("unable to determine datacenter of Consul agent")
+	}
+	c.datacenter = datacenter
+	return datacenter, nil
+}
+
+// resolveDatacenters returns the datacenters to collect from: those listed
+// in c.Datacenters, every datacenter known to Consul if that includes
+// AllDatacenters, or just the local agent's datacenter if it's empty.
+func (c *Collector) resolveDatacenters(stopCh <-chan struct{}) ([]string, error) {
+	if len(c.Datacenters) == 0 {
+		datacenter, err := c.localDatacenter(stopCh)
+		if err != nil {
+			return nil, err
+		}
+		return []string{datacenter}, nil
+	}
+
+	for _, datacenter := range c.Datacenters {
+		if datacenter != AllDatacenters {
+			continue
+		}
+		var datacenters []string
+		err := c.call(stopCh, catalogDatacentersEndpoint, "datacenters", func(context.Context) (err error) {
+			datacenters, err = c.catalogDatacentersFunc()
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(datacenters)
+		return datacenters, nil
+	}
+	return c.Datacenters, nil
+}
@@ -0,0 +1,156 @@
+package consul2dogstats
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// Largest UDP payload that won't be fragmented on a typical 1500 byte MTU
+	// link once IP and UDP headers are accounted for.
+	defaultUDPPacketSize = 1432
+	// Default receive buffer size of the Datadog agent's Unix socket listener.
+	defaultUDSPacketSize = 8192
+
+	unixSocketPrefix = "unix://"
+)
+
+var (
+	// Characters which would corrupt the DogStatsD datagram format if they
+	// appeared in a metric name or tag.
+	dogStatsdNameReplacer = strings.NewReplacer(":", "_", "|", "_", "@", "_", "\n", "_", "\r", "_")
+	dogStatsdTagReplacer  = strings.NewReplacer(",", "_", "|", "_", "\n", "_", "\r", "_")
+)
+
+// DogStatsdClient publishes metrics to a local DogStatsD agent instead of
+// the Datadog HTTP API.
+type DogStatsdClient struct {
+	network       string
+	addr          string
+	maxPacketSize int
+
+	mtx  sync.Mutex
+	conn net.Conn
+}
+
+// NewDogStatsdClient returns a DogStatsdClient that sends to addr.  The
+// address is either a UDP "host:port" pair, or a path to the agent's Unix
+// domain socket prefixed with "unix://".
+func NewDogStatsdClient(addr string) (*DogStatsdClient, error) {
+	c := new(DogStatsdClient)
+	if strings.HasPrefix(addr, unixSocketPrefix) {
+		c.network = "unixgram"
+		c.addr = strings.TrimPrefix(addr, unixSocketPrefix)
+		c.maxPacketSize = defaultUDSPacketSize
+	} else {
+		c.network = "udp"
+		c.addr = addr
+		c.maxPacketSize = defaultUDPPacketSize
+	}
+	if c.addr == "" {
+		return nil, fmt.Errorf("invalid DogStatsD address %q", addr)
+	}
+	if err := c.connect(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Send sends each of the given metrics to the agent as a gauge, or as a
+// histogram if it has HistogramType, packing as many as will fit into each
+// datagram.  DogStatsD has no notion of timestamps, so the agent stamps the
+// metrics on receipt.
+func (c *DogStatsdClient) Send(metrics []Metric) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.conn == nil {
+		if err := c.connect(); err != nil {
+			return err
+		}
+	}
+
+	var packet bytes.Buffer
+	for _, metric := range metrics {
+		line := formatDogStatsdMetric(metric.Name, metric.Value, metric.Type, metric.Tags)
+		if len(line) > c.maxPacketSize {
+			return fmt.Errorf("metric %s with tags %v exceeds the maximum packet size of %d bytes",
+				metric.Name, metric.Tags, c.maxPacketSize)
+		}
+		if packet.Len() > 0 && packet.Len()+1+len(line) > c.maxPacketSize {
+			if err := c.write(packet.Bytes()); err != nil {
+				return err
+			}
+			packet.Reset()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	if packet.Len() > 0 {
+		return c.write(packet.Bytes())
+	}
+	return nil
+}
+
+// Close closes the connection to the agent.
+func (c *DogStatsdClient) Close() error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	return err
+}
+
+func (c *DogStatsdClient) connect() error {
+	conn, err := net.Dial(c.network, c.addr)
+	if err != nil {
+		return err
+	}
+	c.conn = conn
+	return nil
+}
+
+// write sends a single datagram.  On failure the connection is dropped so
+// that the next call to Send reconnects, which allows us to recover
+// from the agent restarting and recreating its socket.
+func (c *DogStatsdClient) write(packet []byte) error {
+	if _, err := c.conn.Write(packet); err != nil {
+		c.conn.Close()
+		c.conn = nil
+		return err
+	}
+	return nil
+}
+
+// formatDogStatsdMetric renders a single metric in the DogStatsD datagram
+// format, e.g. "consul.service.count:3|g|#service:web,status:passing".
+func formatDogStatsdMetric(name string, value float64, metricType MetricType, tags []string) string {
+	typeCode := "g"
+	if metricType == HistogramType {
+		typeCode = "h"
+	}
+	line := dogStatsdNameReplacer.Replace(name) + ":" +
+		strconv.FormatFloat(value, 'f', -1, 64) + "|" + typeCode
+	if len(tags) > 0 {
+		encodedTags := make([]string, 0, len(tags))
+		for _, tag := range tags {
+			if tag == "" {
+				continue
+			}
+			encodedTags = append(encodedTags, dogStatsdTagReplacer.Replace(tag))
+		}
+		if len(encodedTags) > 0 {
+			line += "|#" + strings.Join(encodedTags, ",")
+		}
+	}
+	return line
+}
@@ -0,0 +1,175 @@
+package consul2dogstats
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestGauge returns a gauge suitable for sending to a sink.
+func newTestGauge(name string, value float64, tags ...string) Metric {
+	return newMetric(name, value, tags)
+}
+
+// readPackets reads datagrams from conn until none arrive for a short while.
+func readPackets(t *testing.T, conn net.PacketConn) []string {
+	var packets []string
+	buf := make([]byte, 65536)
+	for {
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if e, ok := err.(net.Error); ok && e.Timeout() {
+				return packets
+			}
+			t.Fatal(err)
+		}
+		packets = append(packets, string(buf[:n]))
+	}
+}
+
+func TestDogStatsdFormat(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		value      float64
+		metricType MetricType
+		tags       []string
+		want       string
+	}{
+		{"consul.service.count", 3, GaugeType, nil, "consul.service.count:3|g"},
+		{"consul.service.count", 0.5, GaugeType, []string{"status:passing", "service:web"},
+			"consul.service.count:0.5|g|#status:passing,service:web"},
+		{"consul.service.count", 1, GaugeType, []string{"", "test"}, "consul.service.count:1|g|#test"},
+		{"bad:name|g", 1, GaugeType, []string{"a,b", "c|d", "e\nf"}, "bad_name_g:1|g|#a_b,c_d,e_f"},
+		{"consul2dogstats.tick.duration", 0.25, HistogramType, []string{"datacenter:dc1"},
+			"consul2dogstats.tick.duration:0.25|h|#datacenter:dc1"},
+	} {
+		if got := formatDogStatsdMetric(tc.name, tc.value, tc.metricType, tc.tags); got != tc.want {
+			t.Fatalf("expected %q, got %q", tc.want, got)
+		}
+	}
+}
+
+func TestDogStatsdUDP(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	c, err := NewDogStatsdClient(server.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	err = c.Send([]Metric{
+		newTestGauge("consul.service.count", 2, "service:testService1", "status:passing"),
+		newTestGauge("consul.service.count", 1, "service:testService2", "status:critical"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	packets := readPackets(t, server)
+	if len(packets) != 1 {
+		t.Fatalf("expected 1 packet, got %d: %v", len(packets), packets)
+	}
+	want := "consul.service.count:2|g|#service:testService1,status:passing\n" +
+		"consul.service.count:1|g|#service:testService2,status:critical"
+	if packets[0] != want {
+		t.Fatalf("expected %q, got %q", want, packets[0])
+	}
+}
+
+func TestDogStatsdBatching(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	c, err := NewDogStatsdClient(server.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var series []Metric
+	for i := 0; i < 200; i++ {
+		series = append(series, newTestGauge("consul.service.count", 1, "service:testService1", "status:passing"))
+	}
+	if err = c.Send(series); err != nil {
+		t.Fatal(err)
+	}
+
+	var lines int
+	packets := readPackets(t, server)
+	if len(packets) < 2 {
+		t.Fatalf("expected metrics to be split across packets, got %d", len(packets))
+	}
+	for _, packet := range packets {
+		if len(packet) > defaultUDPPacketSize {
+			t.Fatalf("packet of %d bytes exceeds maximum of %d", len(packet), defaultUDPPacketSize)
+		}
+		lines += len(strings.Split(packet, "\n"))
+	}
+	if lines != len(series) {
+		t.Fatalf("expected %d metrics, got %d", len(series), lines)
+	}
+}
+
+func TestDogStatsdOversizedMetric(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	c, err := NewDogStatsdClient(server.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	err = c.Send([]Metric{
+		newTestGauge("consul.service.count", 1, strings.Repeat("x", defaultUDPPacketSize)),
+	})
+	if err == nil {
+		t.Fatal("expected oversized metric to be rejected")
+	}
+}
+
+func TestDogStatsdUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul2dogstats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	socketPath := filepath.Join(dir, "dsd.socket")
+	server, err := net.ListenPacket("unixgram", socketPath)
+	if err != nil {
+		t.Skipf("unixgram sockets unsupported: %v", err)
+	}
+	defer server.Close()
+
+	c, err := NewDogStatsdClient("unix://" + socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err = c.Send([]Metric{newTestGauge("consul.service.count", 4, "service:testService1")}); err != nil {
+		t.Fatal(err)
+	}
+
+	packets := readPackets(t, server)
+	if len(packets) != 1 || packets[0] != "consul.service.count:4|g|#service:testService1" {
+		t.Fatalf("unexpected packets %v", packets)
+	}
+}
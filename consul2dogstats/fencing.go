@@ -0,0 +1,137 @@
+package consul2dogstats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	consul "github.com/hashicorp/consul/api"
+)
+
+// FencingMode selects what happens to a batch of metrics when the leader
+// that collected it can't verify that it still holds its Consul lock, for
+// instance because its session expired while it was cut off from Consul and
+// another instance has since taken over.
+type FencingMode string
+
+const (
+	// NoFencing posts every batch without verifying the lock.
+	NoFencing FencingMode = "off"
+	// TagFencing posts unverified batches tagged fencing:unverified.
+	TagFencing FencingMode = "tag"
+	// SuppressFencing posts only the collector's own consul2dogstats.*
+	// metrics from unverified batches.
+	SuppressFencing FencingMode = "suppress"
+)
+
+// ParseFencingMode returns the FencingMode with the given name.
+func ParseFencingMode(name string) (FencingMode, error) {
+	switch mode := FencingMode(name); mode {
+	case NoFencing, TagFencing, SuppressFencing:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown fencing mode %q; must be one of %q, %q or %q",
+		name, NoFencing, TagFencing, SuppressFencing)
+}
+
+// errLeadershipLost is returned by the main loop when a collection turns out
+// to have been made under a lock that's no longer held, so that the leader
+// gives its locks up and contends for them afresh.
+var errLeadershipLost = errors.New("leadership lost")
+
+// lockLostError is returned by verify when a lock is definitely no longer
+// held by the session that acquired it, as opposed to when Consul couldn't be
+// asked.
+type lockLostError string
+
+func (e lockLostError) Error() string {
+	return string(e)
+}
+
+// fence maps the key of each Consul lock a batch of metrics is collected
+// under to the session which held it when it was acquired.
+type fence map[string]string
+
+// lockSession returns the session holding the Consul lock at lockKey.
+func (c *Collector) lockSession(stopCh <-chan struct{}, lockKey string) (string, error) {
+	var pair *consul.KVPair
+	err := c.call(stopCh, kvEndpoint, "lock holder", func(ctx context.Context) (err error) {
+		pair, _, err = c.kvGetFunc(lockKey, (&consul.QueryOptions{}).WithContext(ctx))
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	if pair == nil || pair.Session == "" {
+		return "", lockLostError(fmt.Sprintf("lock at %s is not held", lockKey))
+	}
+	return pair.Session, nil
+}
+
+// fencing returns whether batches collected under Consul locks are fenced.
+func (c *Collector) fencing() bool {
+	return c.election == ConsulElection && (c.Fencing == TagFencing || c.Fencing == SuppressFencing)
+}
+
+// verify checks that every lock of f is still held by the same session, and
+// that the session is still valid.  An empty fence is always valid.  If a
+// lock is known to have been lost, the error is a lockLostError.
+func (c *Collector) verify(stopCh <-chan struct{}, f fence) error {
+	lockKeys := make([]string, 0, len(f))
+	for lockKey := range f {
+		lockKeys = append(lockKeys, lockKey)
+	}
+	sort.Strings(lockKeys)
+
+	for _, lockKey := range lockKeys {
+		session := f[lockKey]
+		var entry *consul.SessionEntry
+		err := c.call(stopCh, sessionInfoEndpoint, "session info", func(ctx context.Context) (err error) {
+			entry, _, err = c.sessionInfoFunc(session, (&consul.QueryOptions{}).WithContext(ctx))
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if entry == nil {
+			return lockLostError(fmt.Sprintf("session %s of lock at %s has expired", session, lockKey))
+		}
+		holder, err := c.lockSession(stopCh, lockKey)
+		if err != nil {
+			return err
+		}
+		if holder != session {
+			return lockLostError(fmt.Sprintf("lock at %s is held by session %s rather than %s", lockKey, holder, session))
+		}
+	}
+	return nil
+}
+
+// fenced returns the metrics to post from a batch collected under f, given
+// the outcome of verifying f, according to c.Fencing, along with the
+// consul2dogstats.fencing.rejected metric, tagged with tags.  If f is empty,
+// the batch is returned unchanged.
+func (c *Collector) fenced(f fence, verifyErr error, metrics []Metric, tags []string) []Metric {
+	if len(f) == 0 {
+		return metrics
+	}
+	if verifyErr == nil {
+		return append(metrics, newMetric("consul2dogstats.fencing.rejected", 0, tags))
+	}
+
+	log.Warnf("Unable to verify leadership, fencing batch of %d metrics: %s", len(metrics), verifyErr)
+	var fenced []Metric
+	for _, metric := range metrics {
+		switch {
+		case c.Fencing == TagFencing:
+			metric.Tags = append(metric.Tags[:len(metric.Tags):len(metric.Tags)], "fencing:unverified")
+		case !strings.HasPrefix(metric.Name, "consul2dogstats."):
+			continue
+		}
+		fenced = append(fenced, metric)
+	}
+	return append(fenced, newMetric("consul2dogstats.fencing.rejected", 1, tags))
+}
@@ -0,0 +1,195 @@
+package consul2dogstats
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+// runOnce makes c collect once under its lock, through Run.
+func runOnce(t *testing.T, c *Collector) {
+	clock := newTestClock()
+	c.clock = clock
+	c.MaxTicks = 1
+	errCh := runInBackground(context.Background(), c)
+	clock.tick(t, c.collectInterval)
+	if err := waitForRun(t, errCh); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// stealLockWhileCollecting makes another session take over the lock of c
+// while it's collecting.
+func stealLockWhileCollecting(c *Collector, sessions *testSessions) {
+	healthService := c.healthServiceFunc
+	c.healthServiceFunc = func(service, tag string, passingOnly bool, q *consul.QueryOptions) ([]*consul.ServiceEntry, *consul.QueryMeta, error) {
+		sessions.steal()
+		return healthService(service, tag, passingOnly, q)
+	}
+}
+
+func TestFencingVerifiedBatch(t *testing.T) {
+	c, err := newTestCollector(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runOnce(t, c)
+
+	client := c.sink.(*testSink)
+	client.validateMetrics(t,
+		[]string{"service:testService1"},
+		&testStatusCounts{passing: 1, warning: 0, critical: 0})
+	if rejected := client.metricValues("consul2dogstats.fencing.rejected"); !reflect.DeepEqual(rejected, []float64{0}) {
+		t.Fatalf("unexpected fencing rejections %v", rejected)
+	}
+	if requests := client.sumMetric("consul2dogstats.consul.requests", "endpoint:"+sessionInfoEndpoint); requests != 1 {
+		t.Fatalf("expected the session to be verified once, got %v", requests)
+	}
+}
+
+// A collection whose lock has been stolen fails, and the leader steps down
+// and contends for the lock again.
+func TestFencingSuppressesStolenLock(t *testing.T) {
+	c, err := newTestCollector(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	locks := useTestLocks(c)
+	sessions := useTestSessions(c)
+	stealLockWhileCollecting(c, sessions)
+	clock := newTestClock()
+	c.clock = clock
+	c.MaxTicks = 1
+
+	errCh := runInBackground(context.Background(), c)
+	clock.tick(t, c.collectInterval)
+	waitFor(t, "the lock to be acquired again", func() bool {
+		created, held := locks.held()
+		return created == 2 && held
+	})
+
+	client := c.sink.(*testSink)
+	if counts := client.metricValues("consul.service.count"); len(counts) != 0 {
+		t.Fatalf("expected service counts to be suppressed, got %v", counts)
+	}
+	if rejected := client.metricValues("consul2dogstats.fencing.rejected"); !reflect.DeepEqual(rejected, []float64{1}) {
+		t.Fatalf("unexpected fencing rejections %v", rejected)
+	}
+	if failed := client.metricValues("consul2dogstats.tick.failed"); !reflect.DeepEqual(failed, []float64{1}) {
+		t.Fatalf("expected the collection to be counted as failed, got %v", failed)
+	}
+	if status := c.Status(); status.Ready() || !strings.Contains(status.LastError, "unable to verify leadership") {
+		t.Fatalf("expected unverified collection to be reported as failed, got %+v", status)
+	}
+
+	// The lock is now held by the session that took it over, so the next
+	// collection is verified.
+	clock.tick(t, c.collectInterval)
+	if err := waitForRun(t, errCh); err != nil {
+		t.Fatal(err)
+	}
+	client.validateMetrics(t,
+		[]string{"service:testService1"},
+		&testStatusCounts{passing: 1, warning: 0, critical: 0})
+}
+
+// A collection whose lock can't be verified because Consul is unavailable is
+// fenced and retried, but the leader keeps its lock.
+func TestFencingKeepsLockWhenConsulUnavailable(t *testing.T) {
+	c, err := newTestCollector(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	locks := useTestLocks(c)
+	sessionInfo := c.sessionInfoFunc
+	calls := 0
+	c.sessionInfoFunc = func(id string, q *consul.QueryOptions) (*consul.SessionEntry, *consul.QueryMeta, error) {
+		calls++
+		if calls == 1 {
+			return nil, nil, errors.New("No cluster leader")
+		}
+		return sessionInfo(id, q)
+	}
+	clock := newTestClock()
+	c.clock = clock
+	c.MaxTicks = 2
+
+	client := c.sink.(*testSink)
+	errCh := runInBackground(context.Background(), c)
+	clock.tick(t, c.collectInterval)
+	waitFor(t, "the collection to be retried", func() bool {
+		clock.advance(time.Millisecond)
+		return len(client.metricValues("consul2dogstats.tick.failed")) == 2
+	})
+	if err := waitForRun(t, errCh); err != nil {
+		t.Fatal(err)
+	}
+
+	if created, _ := locks.held(); created != 1 {
+		t.Fatalf("expected the lock to be kept, but it was acquired %d times", created)
+	}
+	if rejected := client.metricValues("consul2dogstats.fencing.rejected"); !reflect.DeepEqual(rejected, []float64{1, 0}) {
+		t.Fatalf("unexpected fencing rejections %v", rejected)
+	}
+	if status := c.Status(); status.LastError != "" {
+		t.Fatalf("expected the retry to succeed, got %+v", status)
+	}
+	client.validateMetrics(t,
+		[]string{"service:testService1"},
+		&testStatusCounts{passing: 1, warning: 0, critical: 0})
+}
+
+func TestFencingTagsExpiredSession(t *testing.T) {
+	c, err := newTestCollector(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Fencing = TagFencing
+	useTestSessions(c).expire()
+	if err = c.CollectOnce(context.Background(), true); err == nil || !strings.Contains(err.Error(), "has expired") {
+		t.Fatalf("expected the expired session to fail the collection, got %v", err)
+	}
+
+	client := c.sink.(*testSink)
+	client.validateMetrics(t,
+		[]string{"service:testService1", "fencing:unverified"},
+		&testStatusCounts{passing: 1, warning: 0, critical: 0})
+	if rejected := client.metricValues("consul2dogstats.fencing.rejected"); !reflect.DeepEqual(rejected, []float64{1}) {
+		t.Fatalf("unexpected fencing rejections %v", rejected)
+	}
+}
+
+func TestFencingOff(t *testing.T) {
+	c, err := newTestCollector(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Fencing = NoFencing
+	sessions := useTestSessions(c)
+	stealLockWhileCollecting(c, sessions)
+	runOnce(t, c)
+
+	client := c.sink.(*testSink)
+	client.validateMetrics(t,
+		[]string{"service:testService1"},
+		&testStatusCounts{passing: 1, warning: 0, critical: 0})
+	if rejected := client.metricValues("consul2dogstats.fencing.rejected"); len(rejected) != 0 {
+		t.Fatalf("expected no fencing, got %v", rejected)
+	}
+}
+
+func TestParseFencingMode(t *testing.T) {
+	for _, name := range []string{"off", "tag", "suppress"} {
+		if mode, err := ParseFencingMode(name); err != nil || string(mode) != name {
+			t.Fatalf("failed to parse %q: %v", name, err)
+		}
+	}
+	if _, err := ParseFencingMode("bogus"); err == nil {
+		t.Fatal("expected unknown fencing mode to be rejected")
+	}
+}
@@ -0,0 +1,148 @@
+package consul2dogstats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+const (
+	defaultConcurrency    = 8
+	defaultRequestTimeout = 30 * time.Second
+)
+
+// errCollectionStopped is returned when a collection is abandoned because
+// the collector is stopping.
+var errCollectionStopped = errors.New("collection stopped")
+
+// call runs fn, which performs a single request to the given Consul
+// endpoint, and waits for it to finish.  It gives up early if the request
+// takes longer than c.RequestTimeout, or if stopCh is closed, in which case
+// the context passed to fn is cancelled so that the request is aborted.  The
+// outcome is recorded in c.stats.  fn must not touch any state the caller
+// reads afterwards unless call returns nil.
+func (c *Collector) call(stopCh <-chan struct{}, endpoint, what string, fn func(ctx context.Context) error) (err error) {
+	defer func() {
+		c.stats.request(endpoint, err)
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	doneCh := make(chan error, 1)
+	go func() {
+		doneCh <- fn(ctx)
+	}()
+
+	var timeoutCh <-chan time.Time
+	if c.RequestTimeout > 0 {
+		timer := time.NewTimer(c.RequestTimeout)
+		defer timer.Stop()
+		timeoutCh = timer.C
+	}
+	select {
+	case err := <-doneCh:
+		return err
+	case <-timeoutCh:
+		return fmt.Errorf("timed out after %s querying %s", c.RequestTimeout, what)
+	case <-stopCh:
+		return errCollectionStopped
+	}
+}
+
+// fetchServiceHealth queries the health of each of the named services in a
+// datacenter, using up to c.Concurrency requests at a time.  The first error
+// encountered cancels the remaining requests and is returned.
+func (c *Collector) fetchServiceHealth(datacenter string, serviceNames []string, stopCh <-chan struct{}) (map[string][]*consul.ServiceEntry, error) {
+	names := append([]string(nil), serviceNames...)
+	sort.Strings(names)
+
+	// Each request writes only to its own slot of results, which are merged
+	// in order once every request is done.
+	results := make([][]*consul.ServiceEntry, len(names))
+	err := c.fetchEach(len(names), stopCh, func(i int, abortCh <-chan struct{}) error {
+		var entries []*consul.ServiceEntry
+		err := c.call(abortCh, healthServiceEndpoint, "health of service "+names[i], func(ctx context.Context) (err error) {
+			entries, _, err = c.healthServiceFunc(names[i], "", false,
+				(&consul.QueryOptions{Datacenter: datacenter}).WithContext(ctx))
+			return err
+		})
+		if err == nil {
+			results[i] = entries
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	health := make(map[string][]*consul.ServiceEntry, len(names))
+	for i, name := range names {
+		health[name] = results[i]
+	}
+	return health, nil
+}
+
+// fetchEach calls fetch for each index below n, running up to c.Concurrency
+// calls at a time.  The first error encountered closes the abort channel
+// passed to the calls still running, skips the remaining ones and is
+// returned.
+func (c *Collector) fetchEach(n int, stopCh <-chan struct{}, fetch func(i int, abortCh <-chan struct{}) error) error {
+	workers := c.Concurrency
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > n {
+		workers = n
+	}
+
+	abortCh := make(chan struct{})
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+	)
+	abort := func(err error) {
+		once.Do(func() {
+			firstErr = err
+			close(abortCh)
+		})
+	}
+	go func() {
+		select {
+		case <-stopCh:
+			abort(errCollectionStopped)
+		case <-abortCh:
+		}
+	}()
+
+	indexCh := make(chan int)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexCh {
+				if err := fetch(i, abortCh); err != nil {
+					abort(err)
+				}
+			}
+		}()
+	}
+
+FEED:
+	for i := 0; i < n; i++ {
+		select {
+		case indexCh <- i:
+		case <-abortCh:
+			break FEED
+		}
+	}
+	close(indexCh)
+	wg.Wait()
+	abort(nil) // release the stopCh watcher
+
+	return firstErr
+}
@@ -0,0 +1,82 @@
+package consul2dogstats
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// fileLockRetryInterval is how often to try again to take a file lock held
+// by another process.
+const fileLockRetryInterval = time.Second
+
+// fileLock is a leaderLock held with an exclusive lock on a local file,
+// which is created if need be.  The file is left in place when the lock is
+// released, since removing it would let two processes lock different files
+// at the same path.  A file lock is only lost when the process holding it
+// exits, so the channel returned by Lock is never closed.
+type fileLock struct {
+	path          string
+	retryInterval time.Duration
+
+	mtx  sync.Mutex
+	file *os.File
+}
+
+// newFileLock returns a lock on the file at path, which is tried every
+// retryInterval while another process holds it.
+func newFileLock(path string, retryInterval time.Duration) (*fileLock, error) {
+	if path == "" {
+		return nil, errors.New("no lock file given")
+	}
+	return &fileLock{path: path, retryInterval: retryInterval}, nil
+}
+
+func (l *fileLock) Lock(stopCh <-chan struct{}) (<-chan struct{}, error) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.file != nil {
+		return nil, fmt.Errorf("%s is already locked", l.path)
+	}
+
+	file, err := os.OpenFile(l.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		locked, err := tryLockFile(file)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to lock %s: %s", l.path, err)
+		}
+		if locked {
+			l.file = file
+			return make(chan struct{}), nil
+		}
+		select {
+		case <-stopCh:
+			file.Close()
+			return nil, nil
+		case <-time.After(l.retryInterval):
+		}
+	}
+}
+
+// Unlock releases the lock by closing the file.
+func (l *fileLock) Unlock() error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.file == nil {
+		return fmt.Errorf("%s is not locked", l.path)
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// Destroy does nothing, since the lock file is left in place.
+func (l *fileLock) Destroy() error {
+	return nil
+}
@@ -0,0 +1,22 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package consul2dogstats
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileLocksSupported is true on the platforms with flock(2).
+const fileLocksSupported = true
+
+// tryLockFile takes an exclusive lock on file without waiting, returning
+// false if another process holds it.
+func tryLockFile(file *os.File) (bool, error) {
+	err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,16 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package consul2dogstats
+
+import (
+	"errors"
+	"os"
+)
+
+// fileLocksSupported is false on the platforms without flock(2).
+const fileLocksSupported = false
+
+func tryLockFile(file *os.File) (bool, error) {
+	return false, errors.New("file locks are not supported on this platform")
+}
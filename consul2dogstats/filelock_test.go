@@ -0,0 +1,106 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package consul2dogstats
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// lockInBackground locks lock in the background, sending the channel
+// returned by Lock once it does.
+func lockInBackground(t *testing.T, lock leaderLock, stopCh <-chan struct{}) <-chan (<-chan struct{}) {
+	lockedCh := make(chan (<-chan struct{}), 1)
+	go func() {
+		lockLost, err := lock.Lock(stopCh)
+		if err != nil {
+			t.Error(err)
+		}
+		lockedCh <- lockLost
+	}()
+	return lockedCh
+}
+
+func TestFileLockExclusive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul2dogstats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "lock")
+
+	first, _ := newFileLock(path, time.Millisecond)
+	if lockLost, err := first.Lock(nil); err != nil || lockLost == nil {
+		t.Fatalf("failed to acquire lock: %v", err)
+	}
+
+	// A second lock waits for the first to be released.
+	second, _ := newFileLock(path, time.Millisecond)
+	lockedCh := lockInBackground(t, second, nil)
+	select {
+	case <-lockedCh:
+		t.Fatal("acquired a lock already held")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := first.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case lockLost := <-lockedCh:
+		if lockLost == nil {
+			t.Fatal("expected the lock to be acquired")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("lock was not acquired once released")
+	}
+
+	// Waiting for the lock stops when asked.
+	third, _ := newFileLock(path, time.Millisecond)
+	stopCh := make(chan struct{})
+	lockedCh = lockInBackground(t, third, stopCh)
+	close(stopCh)
+	if lockLost := <-lockedCh; lockLost != nil {
+		t.Fatal("acquired a lock already held")
+	}
+	if err := second.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFileElectionLockPaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul2dogstats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := DefaultConfig()
+	cfg.LeaderElection = FileElection
+	cfg.LockFile = filepath.Join(dir, "c2d.lock")
+
+	newLock, err := newLocker(nil, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, path := range map[string]string{
+		cfg.LockPath:          cfg.LockFile,
+		cfg.LockPath + "/dc1": cfg.LockFile + ".dc1",
+	} {
+		lock, err := newLock(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = lock.Lock(nil); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = os.Stat(path); err != nil {
+			t.Fatalf("expected lock at %s to lock %s: %s", key, path, err)
+		}
+		if err = lock.Unlock(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package consul2dogstats
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Pattern matches names in one of three ways: a regular expression if
+// written between slashes (e.g. "/^build-[0-9a-f]+$/"), a glob if it contains
+// "*" (any run of characters) or "?" (any single character), or otherwise
+// exactly.
+type Pattern struct {
+	source string
+	exact  string
+	re     *regexp.Regexp
+}
+
+// ParsePattern returns the Pattern written as s.
+func ParsePattern(s string) (*Pattern, error) {
+	p := &Pattern{source: s}
+	switch {
+	case len(s) >= 2 && strings.HasPrefix(s, "/") && strings.HasSuffix(s, "/"):
+		re, err := regexp.Compile(s[1 : len(s)-1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %s", s, err)
+		}
+		p.re = re
+	case strings.ContainsAny(s, "*?"):
+		glob := regexp.QuoteMeta(s)
+		glob = strings.Replace(glob, `\*`, ".*", -1)
+		glob = strings.Replace(glob, `\?`, ".", -1)
+		p.re = regexp.MustCompile("^" + glob + "$")
+	default:
+		p.exact = s
+	}
+	return p, nil
+}
+
+// Match returns true if name matches the pattern.
+func (p *Pattern) Match(name string) bool {
+	if p.re != nil {
+		return p.re.MatchString(name)
+	}
+	return name == p.exact
+}
+
+// isRegexp returns true if the pattern is a regular expression.
+func (p *Pattern) isRegexp() bool {
+	return p.re != nil && strings.HasPrefix(p.source, "/")
+}
+
+func (p *Pattern) String() string {
+	return p.source
+}
+
+// Filter decides which names to keep: those that match any of the Include
+// patterns, or every name if there are none, unless they also match any of
+// the Exclude patterns.  A nil Filter keeps everything.
+type Filter struct {
+	Include []*Pattern
+	Exclude []*Pattern
+}
+
+// NewFilter returns a Filter of the given include and exclude patterns, or
+// nil if there are none.
+func NewFilter(include, exclude []string) (*Filter, error) {
+	if len(include) == 0 && len(exclude) == 0 {
+		return nil, nil
+	}
+	f := new(Filter)
+	for _, s := range include {
+		p, err := ParsePattern(s)
+		if err != nil {
+			return nil, err
+		}
+		f.Include = append(f.Include, p)
+	}
+	for _, s := range exclude {
+		p, err := ParsePattern(s)
+		if err != nil {
+			return nil, err
+		}
+		f.Exclude = append(f.Exclude, p)
+	}
+	return f, nil
+}
+
+// Match returns true if name should be kept.
+func (f *Filter) Match(name string) bool {
+	if f == nil {
+		return true
+	}
+	for _, p := range f.Exclude {
+		if p.Match(name) {
+			return false
+		}
+	}
+	if len(f.Include) == 0 {
+		return true
+	}
+	for _, p := range f.Include {
+		if p.Match(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterCatalog returns the services of a catalog, as returned by
+// /v1/catalog/services, whose names should be kept.
+func (f *Filter) filterCatalog(services map[string][]string) map[string][]string {
+	if f == nil {
+		return services
+	}
+	filtered := make(map[string][]string, len(services))
+	for name, tags := range services {
+		if f.Match(name) {
+			filtered[name] = tags
+		}
+	}
+	return filtered
+}
+
+// filterTags returns the tags which should be kept, in a new slice.
+func (f *Filter) filterTags(tags []string) []string {
+	filtered := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		if f.Match(tag) {
+			filtered = append(filtered, tag)
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,234 @@
+package consul2dogstats
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+// HealthStrategy selects how the collector fetches the health of services
+// when polling.
+type HealthStrategy string
+
+const (
+	// PerServiceStrategy queries the catalog, then the health of each
+	// service in turn.  It makes one request per service on every tick.
+	PerServiceStrategy HealthStrategy = "per-service"
+	// BulkStrategy fetches every health check in the datacenter with a
+	// single request to /v1/health/state/any and attaches the checks to the
+	// service instances in the catalog, which are only listed again once
+	// their service changes.
+	BulkStrategy HealthStrategy = "bulk"
+)
+
+// ParseHealthStrategy returns the HealthStrategy with the given name.
+func ParseHealthStrategy(name string) (HealthStrategy, error) {
+	switch strategy := HealthStrategy(name); strategy {
+	case PerServiceStrategy, BulkStrategy:
+		return strategy, nil
+	}
+	return "", fmt.Errorf("unknown health strategy %q; must be one of %q or %q",
+		name, PerServiceStrategy, BulkStrategy)
+}
+
+// bulkServiceHealth queries Consul for the catalog of a datacenter, for every
+// health check in it and for the instances of its services, and attaches the
+// checks to the instances to build service entries as /v1/health/service/:name
+// would have returned them.  Instances are taken from the catalog rather than
+// from the checks, so that instances without any checks of their own are
+// counted too.  The instances of each service are cached until its tags or
+// its checked instances change, so that most collections only make two
+// requests.  The checks are returned too, so that node metrics don't need to
+// fetch them again.
+func (c *Collector) bulkServiceHealth(datacenter string, stopCh <-chan struct{}) (map[string][]*consul.ServiceEntry, consul.HealthChecks, error) {
+	var services map[string][]string
+	err := c.call(stopCh, catalogServicesEndpoint, "service catalog", func(ctx context.Context) (err error) {
+		services, _, err = c.catalogServicesFunc((&consul.QueryOptions{Datacenter: datacenter}).WithContext(ctx))
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	services = c.shardCatalog(datacenter, c.ServiceFilter.filterCatalog(services))
+
+	var checks consul.HealthChecks
+	err = c.call(stopCh, healthStateEndpoint, "health state", func(ctx context.Context) (err error) {
+		checks, _, err = c.healthStateFunc(consul.HealthAny, (&consul.QueryOptions{Datacenter: datacenter}).WithContext(ctx))
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	nodeChecks := make(map[string][]*consul.HealthCheck)
+	serviceChecks := make(map[[2]string][]*consul.HealthCheck)
+	for _, check := range checks {
+		if check.ServiceID == "" {
+			nodeChecks[check.Node] = append(nodeChecks[check.Node], check)
+			continue
+		}
+		key := [2]string{check.Node, check.ServiceID}
+		serviceChecks[key] = append(serviceChecks[key], check)
+	}
+	checked := make(map[string][]string)
+	for key, instanceChecks := range serviceChecks {
+		serviceName := instanceChecks[0].ServiceName
+		checked[serviceName] = append(checked[serviceName], key[0]+"/"+key[1])
+	}
+
+	instances, err := c.serviceInstances(datacenter, services, checked, stopCh)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	health := make(map[string][]*consul.ServiceEntry, len(services))
+	for serviceName := range services {
+		entries := make([]*consul.ServiceEntry, 0, len(instances[serviceName]))
+		for _, instance := range instances[serviceName] {
+			// Like /v1/health/service/:name, list node checks before service checks
+			entryChecks := append(append([]*consul.HealthCheck(nil), nodeChecks[instance.Node]...),
+				serviceChecks[[2]string{instance.Node, instance.ServiceID}]...)
+			entries = append(entries, &consul.ServiceEntry{
+				Node: &consul.Node{
+					ID:              instance.ID,
+					Node:            instance.Node,
+					Address:         instance.Address,
+					Datacenter:      instance.Datacenter,
+					TaggedAddresses: instance.TaggedAddresses,
+					Meta:            instance.NodeMeta,
+				},
+				Service: &consul.AgentService{
+					ID:      instance.ServiceID,
+					Service: instance.ServiceName,
+					Tags:    instance.ServiceTags,
+					Meta:    instance.ServiceMeta,
+					Port:    instance.ServicePort,
+					Address: instance.ServiceAddress,
+				},
+				Checks: entryChecks,
+			})
+		}
+		sort.Sort(serviceEntriesByNode(entries))
+		health[serviceName] = entries
+	}
+	return health, checks, nil
+}
+
+// serviceInstances returns the instances of the given services of a
+// datacenter, given the tags of each service listed by the catalog and the
+// node and ID of each of its instances with checks.  Those not cached, or
+// whose tags or checked instances have changed since, are fetched from
+// /v1/catalog/service/:name, using up to c.Concurrency requests at a time.
+func (c *Collector) serviceInstances(datacenter string, services map[string][]string, checked map[string][]string, stopCh <-chan struct{}) (map[string][]*consul.CatalogService, error) {
+	now := c.clock.Now()
+	cached := c.instances.get(datacenter)
+	current := make(map[string]*cachedService, len(services))
+	var missing []string
+	for serviceName, tags := range services {
+		tagsDigest, checkedDigest := stringsDigest(tags), stringsDigest(checked[serviceName])
+		if s := cached[serviceName]; s != nil && s.tags == tagsDigest && s.checked == checkedDigest && now.Before(s.expires) {
+			current[serviceName] = s
+			continue
+		}
+		current[serviceName] = &cachedService{
+			tags:    tagsDigest,
+			checked: checkedDigest,
+			// Spread the expiry of the services by a hash of their name,
+			// so that they aren't all fetched again at once.
+			expires: now.Add(instanceMaxAge/2 +
+				time.Duration(rendezvousScore("", datacenter, serviceName)%uint64(instanceMaxAge/2))),
+		}
+		missing = append(missing, serviceName)
+	}
+	sort.Strings(missing)
+
+	// Each request writes only to its own slot of results.
+	results := make([][]*consul.CatalogService, len(missing))
+	err := c.fetchEach(len(missing), stopCh, func(i int, abortCh <-chan struct{}) error {
+		var instances []*consul.CatalogService
+		err := c.call(abortCh, catalogServiceEndpoint, "instances of service "+missing[i], func(ctx context.Context) (err error) {
+			instances, _, err = c.catalogServiceFunc(missing[i], "",
+				(&consul.QueryOptions{Datacenter: datacenter}).WithContext(ctx))
+			return err
+		})
+		if err == nil {
+			results[i] = instances
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i, serviceName := range missing {
+		current[serviceName].instances = results[i]
+	}
+	c.instances.set(datacenter, current)
+
+	instances := make(map[string][]*consul.CatalogService, len(current))
+	for serviceName, s := range current {
+		instances[serviceName] = s.instances
+	}
+	return instances, nil
+}
+
+// instanceMaxAge is the longest the instances of a service stay cached, so
+// that changes which leave its tags and checked instances as they were, such
+// as to node metadata, still show up eventually.
+const instanceMaxAge = 10 * time.Minute
+
+// instanceCache holds the instances of the services of each datacenter.
+type instanceCache struct {
+	mtx         sync.Mutex
+	datacenters map[string]map[string]*cachedService
+}
+
+// cachedService holds the instances of a service, along with digests of the
+// tags the catalog listed for it and of its checked instances when they were
+// fetched.  Registering or deregistering an instance with checks, or with
+// tags no other instance has, changes one or the other.
+type cachedService struct {
+	tags      string
+	checked   string
+	expires   time.Time
+	instances []*consul.CatalogService
+}
+
+// get returns the services cached for a datacenter.
+func (ic *instanceCache) get(datacenter string) map[string]*cachedService {
+	ic.mtx.Lock()
+	defer ic.mtx.Unlock()
+	return ic.datacenters[datacenter]
+}
+
+// set replaces the services cached for a datacenter.
+func (ic *instanceCache) set(datacenter string, services map[string]*cachedService) {
+	ic.mtx.Lock()
+	defer ic.mtx.Unlock()
+	if ic.datacenters == nil {
+		ic.datacenters = make(map[string]map[string]*cachedService)
+	}
+	ic.datacenters[datacenter] = services
+}
+
+// stringsDigest returns a digest of a list of strings, regardless of their
+// order.
+func stringsDigest(list []string) string {
+	sorted := append([]string(nil), list...)
+	sort.Strings(sorted)
+	return fmt.Sprintf("%q", sorted)
+}
+
+// serviceEntriesByNode sorts service entries by node name, then service ID.
+type serviceEntriesByNode []*consul.ServiceEntry
+
+func (e serviceEntriesByNode) Len() int      { return len(e) }
+func (e serviceEntriesByNode) Swap(i, j int) { e[i], e[j] = e[j], e[i] }
+func (e serviceEntriesByNode) Less(i, j int) bool {
+	if e[i].Node.Node != e[j].Node.Node {
+		return e[i].Node.Node < e[j].Node.Node
+	}
+	return e[i].Service.ID < e[j].Service.ID
+}
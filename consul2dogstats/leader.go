@@ -0,0 +1,84 @@
+package consul2dogstats
+
+import (
+	"fmt"
+	"strings"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+// LeaderElection selects how the collector elects the instance that
+// collects.
+type LeaderElection string
+
+const (
+	// ConsulElection elects a leader with a lock in the Consul KV store.
+	ConsulElection LeaderElection = "consul"
+	// FileElection elects a leader with a lock on a local file, for
+	// collectors sharing a host.
+	FileElection LeaderElection = "file"
+	// NoElection makes every collector a leader, for deployments with a
+	// single collector.
+	NoElection LeaderElection = "none"
+)
+
+// ParseLeaderElection returns the LeaderElection with the given name.
+func ParseLeaderElection(name string) (LeaderElection, error) {
+	switch election := LeaderElection(name); election {
+	case ConsulElection, FileElection, NoElection:
+		return election, nil
+	}
+	return "", fmt.Errorf("unknown leader election %q; must be one of %q, %q or %q",
+		name, ConsulElection, FileElection, NoElection)
+}
+
+// leaderLock elects the leader of a lock key for a single term.  Lock waits
+// until the lock is acquired or stopCh is closed, in which case it returns
+// a nil channel.  Otherwise, the channel it returns is closed if the lock is
+// lost.  A leaderLock can't be locked again once it's been unlocked.
+type leaderLock interface {
+	Lock(stopCh <-chan struct{}) (<-chan struct{}, error)
+	Unlock() error
+	Destroy() error
+}
+
+// newLocker returns the function creating the leader locks for the leader
+// election configured by cfg.
+func newLocker(consulClient *consul.Client, cfg *Config) (func(key string) (leaderLock, error), error) {
+	switch cfg.LeaderElection {
+	case ConsulElection:
+		lockOptions := LockOptions{
+			SessionTTL:     cfg.LockSessionTTL,
+			WaitTime:       cfg.LockWaitTime,
+			MonitorRetries: cfg.LockMonitorRetries,
+			SessionName:    cfg.LockSessionName,
+		}
+		return func(key string) (leaderLock, error) {
+			return consulClient.LockOpts(lockOptions.consulLockOptions(key))
+		}, nil
+	case FileElection:
+		// Per-datacenter locks, beneath the lock key, are files alongside
+		// the lock file.
+		return func(key string) (leaderLock, error) {
+			suffix := strings.Replace(strings.TrimPrefix(key, cfg.LockPath), "/", ".", -1)
+			return newFileLock(cfg.LockFile+suffix, fileLockRetryInterval)
+		}, nil
+	case NoElection:
+		return func(string) (leaderLock, error) {
+			return new(alwaysLeaderLock), nil
+		}, nil
+	}
+	_, err := ParseLeaderElection(string(cfg.LeaderElection))
+	return nil, err
+}
+
+// alwaysLeaderLock is a leaderLock which is acquired straight away and never
+// lost.
+type alwaysLeaderLock struct{}
+
+func (*alwaysLeaderLock) Lock(stopCh <-chan struct{}) (<-chan struct{}, error) {
+	return make(chan struct{}), nil
+}
+
+func (*alwaysLeaderLock) Unlock() error  { return nil }
+func (*alwaysLeaderLock) Destroy() error { return nil }
@@ -0,0 +1,50 @@
+package consul2dogstats
+
+import (
+	"context"
+	"testing"
+)
+
+func TestParseLeaderElection(t *testing.T) {
+	for _, name := range []string{"consul", "file", "none"} {
+		if election, err := ParseLeaderElection(name); err != nil || string(election) != name {
+			t.Fatalf("failed to parse %q: %v", name, err)
+		}
+	}
+	if _, err := ParseLeaderElection("raft"); err == nil {
+		t.Fatal("expected unknown leader election to be rejected")
+	}
+}
+
+func TestNoElection(t *testing.T) {
+	c, err := newTestCollector(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultConfig()
+	cfg.LeaderElection = NoElection
+	if c.newLock, err = newLocker(nil, cfg); err != nil {
+		t.Fatal(err)
+	}
+	c.election = NoElection
+	clock := newTestClock()
+	c.clock = clock
+
+	stop := startCollector(c)
+	waitFor(t, "leadership", func() bool { return c.Status().Leader })
+	clock.tick(t, c.collectInterval)
+	clock.tick(t, c.collectInterval)
+	if status := c.Status(); status.Election != NoElection {
+		t.Fatalf("expected election to be reported, got %+v", status)
+	}
+	if err := stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !c.sink.(*testSink).hasMetric(1, "service:testService1", "status:passing") {
+		t.Fatal("expected counts to be posted without a lock")
+	}
+	if err := c.CollectOnce(context.Background(), true); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,42 @@
+package consul2dogstats
+
+import (
+	"fmt"
+	"sort"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+// metaTags returns a key:value tag for each of the keys in c.ServiceMetaTags
+// found in the metadata of a service instance, and each of the keys in
+// c.NodeMetaTags found in the metadata of its node.  Keys missing or empty
+// in the metadata are left out.
+func (c *Collector) metaTags(entry *consul.ServiceEntry) []string {
+	var tags []string
+	if entry.Service != nil {
+		tags = appendMetaTags(tags, c.ServiceMetaTags, entry.Service.Meta)
+	}
+	if entry.Node != nil {
+		tags = appendMetaTags(tags, c.NodeMetaTags, entry.Node.Meta)
+	}
+	return tags
+}
+
+func appendMetaTags(tags []string, keys []string, meta map[string]string) []string {
+	for _, key := range keys {
+		if value := meta[key]; value != "" {
+			tags = append(tags, key+":"+value)
+		}
+	}
+	return tags
+}
+
+// metaDigest summarizes metadata for healthDigest.
+func metaDigest(meta map[string]string) string {
+	pairs := make([]string, 0, len(meta))
+	for key, value := range meta {
+		pairs = append(pairs, fmt.Sprintf("%q=%q", key, value))
+	}
+	sort.Strings(pairs)
+	return fmt.Sprintf("%q", pairs)
+}
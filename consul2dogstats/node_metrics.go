@@ -0,0 +1,82 @@
+package consul2dogstats
+
+import (
+	"context"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+// nodeStatuses lists the statuses every node count is reported for, even
+// when zero.
+var nodeStatuses = []string{"passing", "warning", "critical", "maintenance"}
+
+// nodeMetrics queries Consul for the nodes of a datacenter and, unless given
+// them, for every health check in it, and counts the nodes by the tags of
+// their metadata listed in c.NodeMetaTags and by status.  The status of a
+// node is the most severe status of its node checks, or "maintenance" if it's
+// in maintenance mode.  Nodes without any checks are passing.
+func (c *Collector) nodeMetrics(datacenter string, checks consul.HealthChecks, stopCh <-chan struct{}) ([]Metric, error) {
+	metricName := "consul.node.count"
+
+	var nodes []*consul.Node
+	err := c.call(stopCh, catalogNodesEndpoint, "node catalog", func(ctx context.Context) (err error) {
+		nodes, _, err = c.catalogNodesFunc((&consul.QueryOptions{Datacenter: datacenter}).WithContext(ctx))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if checks == nil {
+		err = c.call(stopCh, healthStateEndpoint, "node health", func(ctx context.Context) (err error) {
+			checks, _, err = c.healthStateFunc(consul.HealthAny, (&consul.QueryOptions{Datacenter: datacenter}).WithContext(ctx))
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	statusByNode := make(map[string]string, len(nodes))
+	for _, node := range nodes {
+		statusByNode[node.Node] = "passing"
+	}
+	for _, check := range checks {
+		status, ok := statusByNode[check.Node]
+		if !ok || !isNodeCheck(check) || status == "maintenance" {
+			continue
+		}
+		switch {
+		case isMaintenanceCheck(check):
+			statusByNode[check.Node] = "maintenance"
+		case statusSeverity[check.Status] > statusSeverity[status]:
+			statusByNode[check.Node] = check.Status
+		}
+	}
+
+	// The map is keyed by the node's tag set (other than its status), and
+	// holds the number of nodes with those tags in each status.
+	countByTags := make(map[string]*checkCounts)
+	for _, node := range nodes {
+		set := newTagSet(appendMetaTags(nil, c.NodeMetaTags, node.Meta))
+		counts := countByTags[set.key()]
+		if counts == nil {
+			counts = &checkCounts{tags: set, countByStatus: make(map[string]uint)}
+			for _, status := range nodeStatuses {
+				counts.countByStatus[status] = 0
+			}
+			countByTags[set.key()] = counts
+		}
+		counts.countByStatus[statusByNode[node.Node]]++
+	}
+
+	var metrics []Metric
+	for _, counts := range countByTags {
+		for status, count := range counts.countByStatus {
+			tags := counts.tags.with(
+				"status:"+status,
+				"datacenter:"+datacenter)
+			metrics = append(metrics, newMetric(metricName, float64(count), tags))
+		}
+	}
+	return metrics, nil
+}
@@ -0,0 +1,174 @@
+package consul2dogstats
+
+import (
+	"bytes"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// prometheusTagsLabel is the label holding the bare tags (those without a
+// ":") of a series, comma-separated.
+const prometheusTagsLabel = "tags"
+
+var (
+	// Characters not allowed in Prometheus metric and label names.
+	prometheusNameRegexp = regexp.MustCompile("[^a-zA-Z0-9_]")
+	// Characters which must be escaped in label values.
+	prometheusValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+)
+
+// PrometheusExporter exposes metrics as gauges on an HTTP endpoint in the
+// Prometheus text exposition format, for Prometheus to scrape.
+//
+// Metric names have their dots replaced with underscores, so that
+// consul.service.count becomes consul_service_count.  A key:value tag
+// becomes a label named after the key; bare tags are gathered into a single
+// "tags" label.  Series which haven't been sent for longer than the
+// exporter's TTL, such as those of deregistered services, are dropped.
+type PrometheusExporter struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mtx    sync.Mutex
+	series map[string]*prometheusSeries
+}
+
+type prometheusSeries struct {
+	name    string
+	labels  string
+	value   float64
+	updated time.Time
+}
+
+// prometheusSeriesByName sorts series by name, then by labels.
+type prometheusSeriesByName []*prometheusSeries
+
+func (s prometheusSeriesByName) Len() int      { return len(s) }
+func (s prometheusSeriesByName) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s prometheusSeriesByName) Less(i, j int) bool {
+	if s[i].name != s[j].name {
+		return s[i].name < s[j].name
+	}
+	return s[i].labels < s[j].labels
+}
+
+// NewPrometheusExporter returns a PrometheusExporter which drops series that
+// haven't been sent for ttl.
+func NewPrometheusExporter(ttl time.Duration) *PrometheusExporter {
+	return &PrometheusExporter{
+		ttl:    ttl,
+		now:    time.Now,
+		series: make(map[string]*prometheusSeries),
+	}
+}
+
+// Send records the latest value of each of the given metrics.
+func (e *PrometheusExporter) Send(metrics []Metric) error {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	now := e.now()
+	for _, metric := range metrics {
+		name := prometheusName(metric.Name)
+		labels := prometheusLabels(metric.Tags)
+		e.series[name+labels] = &prometheusSeries{
+			name:    name,
+			labels:  labels,
+			value:   metric.Value,
+			updated: now,
+		}
+	}
+	return nil
+}
+
+// ServeHTTP writes every current series in the text exposition format.
+func (e *PrometheusExporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(e.exposition())
+}
+
+// exposition returns every current series in the text exposition format,
+// grouped by metric name.
+func (e *PrometheusExporter) exposition() []byte {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	now := e.now()
+	current := make(prometheusSeriesByName, 0, len(e.series))
+	for key, series := range e.series {
+		if e.ttl > 0 && now.Sub(series.updated) > e.ttl {
+			delete(e.series, key)
+			continue
+		}
+		current = append(current, series)
+	}
+	sort.Sort(current)
+
+	var b bytes.Buffer
+	var lastName string
+	for _, series := range current {
+		if series.name != lastName {
+			b.WriteString("# TYPE " + series.name + " gauge\n")
+			lastName = series.name
+		}
+		b.WriteString(series.name + series.labels + " ")
+		b.WriteString(strconv.FormatFloat(series.value, 'g', -1, 64))
+		b.WriteByte('\n')
+	}
+	return b.Bytes()
+}
+
+// prometheusName converts a Datadog metric or tag name into a valid
+// Prometheus metric or label name.
+func prometheusName(name string) string {
+	name = prometheusNameRegexp.ReplaceAllString(name, "_")
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "_" + name
+	}
+	return name
+}
+
+// prometheusLabels converts Datadog tags into a label set, e.g.
+// {datacenter="dc1",service="web"}.  Labels are sorted by name, and tags
+// with the same key have their values joined with commas.
+func prometheusLabels(tags []string) string {
+	valuesByName := make(map[string][]string)
+	for _, tag := range tags {
+		if tag == "" {
+			continue
+		}
+		name, value := prometheusTagsLabel, tag
+		if i := strings.Index(tag, ":"); i > 0 {
+			name, value = prometheusName(tag[:i]), tag[i+1:]
+		}
+		if strings.HasPrefix(name, "__") {
+			// reserved for Prometheus' internal use
+			if name = strings.TrimLeft(name, "_"); name == "" {
+				name = "_"
+			}
+		}
+		valuesByName[name] = append(valuesByName[name], value)
+	}
+	if len(valuesByName) == 0 {
+		return ""
+	}
+
+	names := make([]string, 0, len(valuesByName))
+	for name := range valuesByName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, 0, len(names))
+	for _, name := range names {
+		values := valuesByName[name]
+		sort.Strings(values)
+		pairs = append(pairs, name+`="`+prometheusValueReplacer.Replace(strings.Join(values, ","))+`"`)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
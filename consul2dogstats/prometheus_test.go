@@ -0,0 +1,108 @@
+package consul2dogstats
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// scrape returns what Prometheus would see scraping e.
+func scrape(t *testing.T, e *PrometheusExporter) string {
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != 200 {
+		t.Fatalf("unexpected status %d", w.Code)
+	}
+	if contentType := w.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain; version=0.0.4") {
+		t.Fatalf("unexpected content type %q", contentType)
+	}
+	return w.Body.String()
+}
+
+func TestPrometheusExposition(t *testing.T) {
+	e := NewPrometheusExporter(time.Minute)
+	err := e.Send([]Metric{
+		newTestGauge("consul.service.count", 2, "status:passing", "service:web", "datacenter:dc1", "canary", "test"),
+		newTestGauge("consul.service.count", 0, "status:critical", "service:web", "datacenter:dc1", "canary", "test"),
+		newTestGauge("consul2dogstats.tick.failed", 1, "datacenter:dc1"),
+		newTestGauge("consul.service.count", 1, "service:api", "shard:2", "shard:1", `route:/a"b\c`, "__name__:evil"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `# TYPE consul2dogstats_tick_failed gauge
+consul2dogstats_tick_failed{datacenter="dc1"} 1
+# TYPE consul_service_count gauge
+consul_service_count{datacenter="dc1",service="web",status="critical",tags="canary,test"} 0
+consul_service_count{datacenter="dc1",service="web",status="passing",tags="canary,test"} 2
+consul_service_count{name__="evil",route="/a\"b\\c",service="api",shard="1,2"} 1
+`
+	if got := scrape(t, e); got != want {
+		t.Fatalf("expected:\n%s\ngot:\n%s", want, got)
+	}
+}
+
+func TestPrometheusUpdatesAndExpiry(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	e := NewPrometheusExporter(30 * time.Second)
+	e.now = func() time.Time { return now }
+
+	e.Send([]Metric{
+		newTestGauge("consul.service.count", 2, "service:web"),
+		newTestGauge("consul.service.count", 1, "service:deregistered"),
+	})
+	now = now.Add(20 * time.Second)
+	e.Send([]Metric{
+		newTestGauge("consul.service.count", 3, "service:web"),
+	})
+
+	got := scrape(t, e)
+	if !strings.Contains(got, `consul_service_count{service="web"} 3`) ||
+		!strings.Contains(got, `consul_service_count{service="deregistered"} 1`) {
+		t.Fatalf("unexpected exposition:\n%s", got)
+	}
+
+	now = now.Add(20 * time.Second)
+	got = scrape(t, e)
+	if strings.Contains(got, "deregistered") {
+		t.Fatalf("expected stale series to be dropped:\n%s", got)
+	}
+	if !strings.Contains(got, `consul_service_count{service="web"} 3`) {
+		t.Fatalf("expected fresh series to be kept:\n%s", got)
+	}
+}
+
+func TestPrometheusName(t *testing.T) {
+	for name, want := range map[string]string{
+		"consul.service.count": "consul_service_count",
+		"availability-zone":    "availability_zone",
+		"9lives":               "_9lives",
+		"":                     "_",
+	} {
+		if got := prometheusName(name); got != want {
+			t.Fatalf("expected %q to become %q, got %q", name, want, got)
+		}
+	}
+}
+
+func TestPrometheusCollector(t *testing.T) {
+	c, err := newTestCollector(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := NewPrometheusExporter(time.Minute)
+	c.sink = e
+	c.runTicks(1)
+
+	got := scrape(t, e)
+	for _, want := range []string{
+		`consul_service_count{datacenter="dc1",service="testService1",status="passing",tags="test"} 1`,
+		`consul_service_count{datacenter="dc1",reason="service",service="testService2",status="critical",tags="test"} 0`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Fatalf("expected exposition to include %s, got:\n%s", want, got)
+		}
+	}
+}
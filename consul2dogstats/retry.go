@@ -0,0 +1,45 @@
+package consul2dogstats
+
+import (
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy controls how the collector reacts to ticks that fail because
+// Consul or Datadog returned an error.
+type RetryPolicy struct {
+	// InitialBackoff is the delay before retrying after the first failure.
+	// It doubles after each further consecutive failure.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the delay between retries.  If zero, the delay does not
+	// grow beyond InitialBackoff.
+	MaxBackoff time.Duration
+	// MaxFailures is the number of consecutive failed ticks tolerated before
+	// the collector gives up and releases its lock.  Zero means never give up.
+	MaxFailures int
+}
+
+// DefaultRetryPolicy is the RetryPolicy of the default configuration.
+var DefaultRetryPolicy = RetryPolicy{
+	InitialBackoff: time.Second,
+	MaxBackoff:     time.Minute,
+	MaxFailures:    10,
+}
+
+// backoff returns how long to wait before retrying after the given number of
+// consecutive failures.  Half of the delay is randomized so that a fleet of
+// collectors recovering from the same outage don't retry in lockstep.
+func (p RetryPolicy) backoff(failures int, rnd *rand.Rand) time.Duration {
+	delay := p.InitialBackoff
+	for i := 1; i < failures && delay < p.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if p.MaxBackoff > 0 && delay > p.MaxBackoff {
+		delay = p.MaxBackoff
+	}
+	if delay <= 1 {
+		return delay
+	}
+	half := delay / 2
+	return half + time.Duration(rnd.Int63n(int64(delay-half)))
+}
@@ -0,0 +1,99 @@
+package consul2dogstats
+
+import (
+	"fmt"
+	"strings"
+)
+
+// TagRule is a rule for rewriting Consul service tags into Datadog tags.  A
+// rule applies to every tag matching its Match pattern (see ParsePattern),
+// or to every tag if Match is empty.  Its actions are applied in the order
+// of the fields below.
+type TagRule struct {
+	Match string `json:"match,omitempty"`
+
+	// Drop removes the tag altogether.
+	Drop bool `json:"drop,omitempty"`
+	// Replace replaces the part of the tag matched by a regular expression
+	// with this template, in which $1, ${name} and so on stand for the
+	// expression's capture groups; e.g. "version:$1".
+	Replace string `json:"replace,omitempty"`
+	// Key turns a bare tag, one without a ":", into a key:value tag with
+	// this key.
+	Key string `json:"key,omitempty"`
+	// Prefix is prepended to the tag.
+	Prefix string `json:"prefix,omitempty"`
+	// Lowercase converts the tag to lower case.
+	Lowercase bool `json:"lowercase,omitempty"`
+}
+
+// TagRewriter applies a list of TagRules to service tags.  Each rule sees
+// the tags as rewritten by the rules before it.  A nil TagRewriter leaves
+// tags unchanged.
+type TagRewriter struct {
+	rules    []TagRule
+	patterns []*Pattern
+}
+
+// NewTagRewriter returns a TagRewriter applying the given rules, or nil if
+// there are none.
+func NewTagRewriter(rules []TagRule) (*TagRewriter, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	r := &TagRewriter{rules: rules, patterns: make([]*Pattern, len(rules))}
+	for i, rule := range rules {
+		if rule.Match != "" {
+			p, err := ParsePattern(rule.Match)
+			if err != nil {
+				return nil, fmt.Errorf("tag rule %d: %s", i+1, err)
+			}
+			r.patterns[i] = p
+		}
+		if rule.Replace != "" && (r.patterns[i] == nil || !r.patterns[i].isRegexp()) {
+			return nil, fmt.Errorf("tag rule %d: replace requires a regular expression to match", i+1)
+		}
+		if rule.Key != "" && strings.Contains(rule.Key, ":") {
+			return nil, fmt.Errorf("tag rule %d: key %q must not contain \":\"", i+1, rule.Key)
+		}
+		if !rule.Drop && rule.Replace == "" && rule.Key == "" && rule.Prefix == "" && !rule.Lowercase {
+			return nil, fmt.Errorf("tag rule %d does nothing", i+1)
+		}
+	}
+	return r, nil
+}
+
+// Rewrite returns the rewritten tags, in a new slice.  Tags rewritten to the
+// empty string are dropped.
+func (r *TagRewriter) Rewrite(tags []string) []string {
+	rewritten := make([]string, 0, len(tags))
+	if r == nil {
+		return append(rewritten, tags...)
+	}
+TAG:
+	for _, tag := range tags {
+		for i, rule := range r.rules {
+			p := r.patterns[i]
+			if p != nil && !p.Match(tag) {
+				continue
+			}
+			if rule.Drop {
+				continue TAG
+			}
+			if rule.Replace != "" {
+				tag = p.re.ReplaceAllString(tag, rule.Replace)
+			}
+			if rule.Key != "" && !strings.Contains(tag, ":") {
+				tag = rule.Key + ":" + tag
+			}
+			tag = rule.Prefix + tag
+			if rule.Lowercase {
+				tag = strings.ToLower(tag)
+			}
+		}
+		if tag != "" {
+			rewritten = append(rewritten, tag)
+		}
+	}
+	return rewritten
+}
@@ -0,0 +1,186 @@
+package consul2dogstats
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Consul API endpoints, as used to tag the request and error counts.
+const (
+	agentSelfEndpoint          = "/v1/agent/self"
+	catalogDatacentersEndpoint = "/v1/catalog/datacenters"
+	catalogNodesEndpoint       = "/v1/catalog/nodes"
+	catalogServiceEndpoint     = "/v1/catalog/service"
+	catalogServicesEndpoint    = "/v1/catalog/services"
+	healthServiceEndpoint      = "/v1/health/service"
+	healthStateEndpoint        = "/v1/health/state"
+	kvEndpoint                 = "/v1/kv"
+	sessionInfoEndpoint        = "/v1/session/info"
+)
+
+// selfStats accumulates what the collector has been doing between posts, to
+// be published alongside the service counts as consul2dogstats.* metrics.
+// Several leaders may share it in per-datacenter lock mode; whichever posts
+// next reports, and resets, the counts gathered by all of them.  The zero
+// value is ready to use.
+type selfStats struct {
+	mtx          sync.Mutex
+	requests     map[string]int
+	errors       map[string]int
+	lockHeld     map[string]bool
+	lockAcquired map[string]int
+	lockLost     map[string]int
+	watchFailing map[string]int
+}
+
+// request records the outcome of a request to the given Consul endpoint.
+// Requests abandoned because the collector is stopping aren't counted.
+func (s *selfStats) request(endpoint string, err error) {
+	if err == errCollectionStopped {
+		return
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.requests = incr(s.requests, endpoint)
+	s.errors = touch(s.errors, endpoint)
+	if err != nil {
+		s.errors[endpoint]++
+	}
+}
+
+// acquired records that the lock at key was acquired.
+func (s *selfStats) acquired(key string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.setHeld(key, true)
+	s.lockAcquired[key]++
+}
+
+// lost records that the lock at key was lost.
+func (s *selfStats) lost(key string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.setHeld(key, false)
+	s.lockLost[key]++
+}
+
+// released records that the lock at key was given up voluntarily.
+func (s *selfStats) released(key string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.setHeld(key, false)
+}
+
+func (s *selfStats) setHeld(key string, held bool) {
+	if s.lockHeld == nil {
+		s.lockHeld = make(map[string]bool)
+	}
+	s.lockHeld[key] = held
+	s.lockAcquired = touch(s.lockAcquired, key)
+	s.lockLost = touch(s.lockLost, key)
+}
+
+// setWatchFailing records the number of watches of the given datacenter
+// whose most recent query failed.
+func (s *selfStats) setWatchFailing(datacenter string, failing int) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.watchFailing == nil {
+		s.watchFailing = make(map[string]int)
+	}
+	s.watchFailing[datacenter] = failing
+}
+
+// forgetWatch stops reporting the watches of the given datacenter.
+func (s *selfStats) forgetWatch(datacenter string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	delete(s.watchFailing, datacenter)
+}
+
+// locks returns whether each lock seen is held.
+func (s *selfStats) locks() map[string]bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	locks := make(map[string]bool, len(s.lockHeld))
+	for key, held := range s.lockHeld {
+		locks[key] = held
+	}
+	return locks
+}
+
+// metrics returns the metrics describing a tick which took duration and
+// collected the given number of series, followed by the requests made and
+// lock changes since the last call, whose counts are then reset.
+func (s *selfStats) metrics(duration time.Duration, series int, tags []string) []Metric {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	metrics := []Metric{
+		newHistogram("consul2dogstats.tick.duration", duration.Seconds(), tags),
+		newMetric("consul2dogstats.series.count", float64(series), tags),
+	}
+	for _, endpoint := range sortedKeys(s.requests) {
+		endpointTags := append(append([]string(nil), tags...), "endpoint:"+endpoint)
+		metrics = append(metrics,
+			newMetric("consul2dogstats.consul.requests", float64(s.requests[endpoint]), endpointTags),
+			newMetric("consul2dogstats.consul.errors", float64(s.errors[endpoint]), endpointTags))
+	}
+	for _, key := range sortedKeys(s.lockAcquired) {
+		var held float64
+		if s.lockHeld[key] {
+			held = 1
+		}
+		lockTags := append(append([]string(nil), tags...), "lock:"+key)
+		metrics = append(metrics,
+			newMetric("consul2dogstats.lock.held", held, lockTags),
+			newMetric("consul2dogstats.lock.acquired", float64(s.lockAcquired[key]), lockTags),
+			newMetric("consul2dogstats.lock.lost", float64(s.lockLost[key]), lockTags))
+	}
+	for _, datacenter := range sortedKeys(s.watchFailing) {
+		watchTags := append(append([]string(nil), tags...), "watch:"+datacenter)
+		metrics = append(metrics,
+			newMetric("consul2dogstats.watch.failing", float64(s.watchFailing[datacenter]), watchTags))
+	}
+
+	// Keep reporting every endpoint and lock seen, with zero counts, so
+	// that gaps in the series mean the collector wasn't running.
+	for endpoint := range s.requests {
+		s.requests[endpoint] = 0
+		s.errors[endpoint] = 0
+	}
+	for key := range s.lockAcquired {
+		s.lockAcquired[key] = 0
+		s.lockLost[key] = 0
+	}
+	return metrics
+}
+
+// touch makes sure m has an entry for key, allocating m if necessary, so
+// that the key is reported even while its count is zero.
+func touch(m map[string]int, key string) map[string]int {
+	if m == nil {
+		m = make(map[string]int)
+	}
+	if _, ok := m[key]; !ok {
+		m[key] = 0
+	}
+	return m
+}
+
+// incr increments m[key], allocating m if necessary.
+func incr(m map[string]int, key string) map[string]int {
+	m = touch(m, key)
+	m[key]++
+	return m
+}
+
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
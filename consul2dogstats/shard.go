@@ -0,0 +1,223 @@
+package consul2dogstats
+
+import (
+	"context"
+	"hash/fnv"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	consul "github.com/hashicorp/consul/api"
+)
+
+// shardMembers tracks the members of a group of collectors sharing the work
+// in sharded lock mode, each of which registers by holding a lock on its
+// own key beneath a common prefix.  Every service is assigned to a single
+// member by rendezvous hashing, so that a member joining or leaving only
+// moves the services it gains or loses.
+type shardMembers struct {
+	id         string
+	prefix     string
+	kvListFunc func(prefix string, q *consul.QueryOptions) (consul.KVPairs, *consul.QueryMeta, error)
+	retry      RetryPolicy
+	stats      *selfStats
+
+	mtx     sync.Mutex
+	rand    *rand.Rand
+	running bool
+	members []string
+}
+
+// newShardMembers returns the members of the shard group of c, which is
+// member id.
+func newShardMembers(c *Collector, id string) *shardMembers {
+	return &shardMembers{
+		id:         id,
+		prefix:     c.lockKey + "/members/",
+		kvListFunc: c.kvListFunc,
+		retry:      c.Retry,
+		stats:      &c.stats,
+		rand:       rand.New(rand.NewSource(c.rand.Int63())),
+	}
+}
+
+// key returns the key of the lock registering this member.
+func (m *shardMembers) key() string {
+	return m.prefix + m.id
+}
+
+// run keeps the list of members up to date, using a blocking query on the
+// keys of their locks, until stopCh is closed.
+func (m *shardMembers) run(stopCh <-chan struct{}) {
+	m.setRunning(true)
+	defer m.setRunning(false)
+	ctx, cancel := stopContext(stopCh)
+	defer cancel()
+
+	var index uint64
+	var failures int
+	for {
+		pairs, meta, err := m.kvListFunc(m.prefix, (&consul.QueryOptions{
+			WaitIndex: index,
+			WaitTime:  watchWaitTime,
+		}).WithContext(ctx))
+		if isClosed(stopCh) {
+			return
+		}
+		m.stats.request(kvEndpoint, err)
+		if err != nil {
+			failures++
+			log.Warnf("Failed to list shard members: %s", err)
+			if !sleep(stopCh, m.backoff(failures)) {
+				return
+			}
+			continue
+		}
+		failures = 0
+		m.update(pairs)
+
+		var ok bool
+		if index, ok = nextIndex(stopCh, index, meta, m.retry.InitialBackoff); !ok {
+			return
+		}
+	}
+}
+
+func (m *shardMembers) setRunning(running bool) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.running = running
+	m.members = nil
+}
+
+func (m *shardMembers) backoff(failures int) time.Duration {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return m.retry.backoff(failures, m.rand)
+}
+
+// update sets the members to those whose lock is held.
+func (m *shardMembers) update(pairs consul.KVPairs) {
+	var members []string
+	for _, pair := range pairs {
+		if pair.Session != "" {
+			members = append(members, strings.TrimPrefix(pair.Key, m.prefix))
+		}
+	}
+	sort.Strings(members)
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if !reflect.DeepEqual(members, m.members) {
+		log.Infof("Shard members are now %s", strings.Join(members, ", "))
+		m.members = members
+	}
+}
+
+// list returns the current members.
+func (m *shardMembers) list() []string {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return append([]string(nil), m.members...)
+}
+
+// loadShardMembers lists the members of the shard group once, and assigns
+// services by them until c.shard.setRunning(false) is called, as when
+// collecting once.
+func (c *Collector) loadShardMembers(stopCh <-chan struct{}) error {
+	var pairs consul.KVPairs
+	err := c.call(stopCh, kvEndpoint, "shard members", func(ctx context.Context) (err error) {
+		pairs, _, err = c.kvListFunc(c.shard.prefix, (&consul.QueryOptions{}).WithContext(ctx))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	c.shard.setRunning(true)
+	c.shard.update(pairs)
+	return nil
+}
+
+// owns returns whether the given service of the given datacenter is
+// assigned to this member.  While the members aren't being tracked, as when
+// collecting once without the lock, every service is.  While they are, none
+// is until this member is seen to be registered.
+func (m *shardMembers) owns(datacenter, service string) bool {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if !m.running {
+		return true
+	}
+	var owner string
+	var ownerScore uint64
+	for _, member := range m.members {
+		if score := rendezvousScore(member, datacenter, service); owner == "" || score > ownerScore {
+			owner, ownerScore = member, score
+		}
+	}
+	return owner == m.id
+}
+
+// rendezvousScore returns the score of a member for a service of a
+// datacenter.  The service is assigned to the member with the highest score.
+func rendezvousScore(member, datacenter, service string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(member + "\x00" + datacenter + "\x00" + service))
+	// Finish with the splitmix64 finalizer, since FNV's high bits are poorly
+	// mixed for keys which only differ at the end.
+	x := h.Sum64()
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
+// shardCatalog returns the services of a catalog of the given datacenter,
+// as returned by /v1/catalog/services, which are assigned to this collector.
+// Without sharding, that's all of them.
+func (c *Collector) shardCatalog(datacenter string, services map[string][]string) map[string][]string {
+	if c.shard == nil {
+		return services
+	}
+	owned := make(map[string][]string, len(services))
+	for name, tags := range services {
+		if c.shard.owns(datacenter, name) {
+			owned[name] = tags
+		}
+	}
+	return owned
+}
+
+// shardHealth returns the health of the services of the given datacenter
+// which are assigned to this collector.  Without sharding, that's all of
+// them.
+func (c *Collector) shardHealth(datacenter string, health map[string][]*consul.ServiceEntry) map[string][]*consul.ServiceEntry {
+	if c.shard == nil {
+		return health
+	}
+	owned := make(map[string][]*consul.ServiceEntry, len(health))
+	for name, entries := range health {
+		if c.shard.owns(datacenter, name) {
+			owned[name] = entries
+		}
+	}
+	return owned
+}
+
+// ownsNodes returns whether the nodes of the given datacenter are counted by
+// this collector.  They're assigned like a service with an empty name, which
+// no service has.  Without sharding, they always are.
+func (c *Collector) ownsNodes(datacenter string) bool {
+	return c.shard == nil || c.shard.owns(datacenter, "")
+}
+
+// runSharded registers this collector as a member of its shard group and
+// collects from the services assigned to it while registered, tracking the
+// other members, until ctx is done or the main loop gives up.
+func (c *Collector) runSharded(ctx context.Context) error {
+	go c.shard.run(ctx.Done())
+	return c.lead(ctx, c.shard.key(), nil)
+}
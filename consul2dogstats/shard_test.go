@@ -0,0 +1,411 @@
+package consul2dogstats
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+func TestRendezvousBalance(t *testing.T) {
+	members := []string{"a", "b", "c"}
+	owners := make(map[string]string)
+	counts := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		service := fmt.Sprintf("service%d", i)
+		owner := testShardOwner(members, "dc1", service)
+		owners[service] = owner
+		counts[owner]++
+	}
+	for _, member := range members {
+		if counts[member] < 800 || counts[member] > 1200 {
+			t.Fatalf("unbalanced shards: %v", counts)
+		}
+	}
+
+	// Only the services of the member leaving should move.
+	for service, owner := range owners {
+		if newOwner := testShardOwner([]string{"a", "c"}, "dc1", service); owner != "b" && newOwner != owner {
+			t.Fatalf("%s moved from %s to %s", service, owner, newOwner)
+		}
+	}
+}
+
+// testShardOwner returns the member owning a service, as seen by every
+// member.
+func testShardOwner(members []string, datacenter, service string) string {
+	var owner string
+	for _, id := range members {
+		m := &shardMembers{id: id, running: true, members: members}
+		if m.owns(datacenter, service) {
+			if owner != "" {
+				panic(fmt.Sprintf("%s owned by both %s and %s", service, owner, id))
+			}
+			owner = id
+		}
+	}
+	return owner
+}
+
+// The nodes of each datacenter are counted by a single member.
+// Stopping the tracking of members abandons its blocking query straight away.
+func TestShardMembersStopCancelsQuery(t *testing.T) {
+	c, err := newTestCollector(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queried := make(chan struct{}, 1)
+	c.kvListFunc = func(prefix string, q *consul.QueryOptions) (consul.KVPairs, *consul.QueryMeta, error) {
+		select {
+		case queried <- struct{}{}:
+		default:
+		}
+		select {
+		case <-q.Context().Done():
+			return nil, nil, q.Context().Err()
+		case <-time.After(watchWaitTime):
+			return nil, &consul.QueryMeta{LastIndex: 1}, nil
+		}
+	}
+	m := newShardMembers(c, "a")
+	stopCh := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		m.run(stopCh)
+		close(done)
+	}()
+
+	<-queried
+	close(stopCh)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("member query not abandoned once stopped")
+	}
+}
+
+func TestShardNodesOwnedOnce(t *testing.T) {
+	for _, datacenter := range []string{"dc1", "dc2", "dc3"} {
+		if owner := testShardOwner([]string{"a", "b", "c"}, datacenter, ""); owner == "" {
+			t.Fatalf("nodes of %s not owned by any member", datacenter)
+		}
+	}
+}
+
+func TestShardOwnsEverythingWhenNotRunning(t *testing.T) {
+	m := &shardMembers{id: "a", members: []string{"b"}}
+	if !m.owns("dc1", "testService1") {
+		t.Fatal("expected every service to be owned when members aren't tracked")
+	}
+	m.running = true
+	if m.owns("dc1", "testService1") {
+		t.Fatal("expected no service to be owned until registered")
+	}
+}
+
+// testShardKV mocks the Consul KV store backing the locks of a shard group.
+// Blocking queries return as soon as the keys change, or after a short wait.
+type testShardKV struct {
+	mtx      sync.Mutex
+	index    uint64
+	sessions map[string]string
+	changed  chan struct{}
+}
+
+func newTestShardKV() *testShardKV {
+	return &testShardKV{index: 1, sessions: make(map[string]string), changed: make(chan struct{})}
+}
+
+func (kv *testShardKV) set(key, session string) {
+	kv.mtx.Lock()
+	defer kv.mtx.Unlock()
+	if session == "" {
+		delete(kv.sessions, key)
+	} else {
+		kv.sessions[key] = session
+	}
+	kv.index++
+	close(kv.changed)
+	kv.changed = make(chan struct{})
+}
+
+func (kv *testShardKV) list(prefix string, q *consul.QueryOptions) (consul.KVPairs, *consul.QueryMeta, error) {
+	kv.mtx.Lock()
+	if q.WaitIndex >= kv.index {
+		changed := kv.changed
+		kv.mtx.Unlock()
+		select {
+		case <-changed:
+		case <-time.After(50 * time.Millisecond):
+		}
+		kv.mtx.Lock()
+	}
+	defer kv.mtx.Unlock()
+	var pairs consul.KVPairs
+	for key, session := range kv.sessions {
+		if strings.HasPrefix(key, prefix) {
+			pairs = append(pairs, &consul.KVPair{Key: key, Session: session})
+		}
+	}
+	return pairs, &consul.QueryMeta{LastIndex: kv.index}, nil
+}
+
+// newLock returns a function creating locks which hold their key in kv
+// under the given session.
+func (kv *testShardKV) newLock(session string) func(key string) (leaderLock, error) {
+	return func(key string) (leaderLock, error) {
+		return &testShardLock{kv: kv, key: key, session: session}, nil
+	}
+}
+
+type testShardLock struct {
+	kv      *testShardKV
+	key     string
+	session string
+}
+
+func (l *testShardLock) Lock(stopCh <-chan struct{}) (<-chan struct{}, error) {
+	l.kv.set(l.key, l.session)
+	return make(chan struct{}), nil
+}
+
+func (l *testShardLock) Unlock() error {
+	l.kv.set(l.key, "")
+	return nil
+}
+
+func (l *testShardLock) Destroy() error { return nil }
+
+// newShardedTestCollector returns a collector of the shard group in kv,
+// collecting from m.
+func newShardedTestCollector(t *testing.T, kv *testShardKV, m *syntheticConsul, id string) (*Collector, *testClock) {
+	c, err := newTestCollector(m.collectorConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.LockMode = ShardedLock
+	c.Fencing = NoFencing
+	c.newLock = kv.newLock("session-" + id)
+	c.kvListFunc = kv.list
+	c.shard = newShardMembers(c, id)
+	clock := newTestClock()
+	c.clock = clock
+	return c, clock
+}
+
+// collectedServices returns the services whose health has been posted to
+// the sink of c, and forgets them.
+func collectedServices(c *Collector) []string {
+	sink := c.sink.(*testSink)
+	sink.mtx.Lock()
+	defer sink.mtx.Unlock()
+	seen := make(map[string]bool)
+	for _, metric := range sink.metrics {
+		if metric.Name != "consul.service.count" {
+			continue
+		}
+		for _, tag := range metric.Tags {
+			if strings.HasPrefix(tag, "service:") {
+				seen[strings.TrimPrefix(tag, "service:")] = true
+			}
+		}
+	}
+	sink.metrics = nil
+	services := make([]string, 0, len(seen))
+	for service := range seen {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+	return services
+}
+
+// collectTwice delivers two ticks, so that the first collection has been
+// posted once it returns.
+func collectTwice(t *testing.T, clock *testClock) {
+	clock.tick(t, time.Minute)
+	clock.tick(t, time.Minute)
+}
+
+func TestShardedCollectorsSplitServices(t *testing.T) {
+	for _, strategy := range []HealthStrategy{PerServiceStrategy, BulkStrategy} {
+		t.Run(string(strategy), func(t *testing.T) {
+			testShardedCollectorsSplitServices(t, strategy)
+		})
+	}
+}
+
+func testShardedCollectorsSplitServices(t *testing.T, strategy HealthStrategy) {
+	m := &syntheticConsul{services: 40, instances: 1, nodes: 5}
+	var all []string
+	for i := 0; i < m.services; i++ {
+		all = append(all, m.serviceName(i))
+	}
+	sort.Strings(all)
+
+	kv := newTestShardKV()
+	a, clockA := newShardedTestCollector(t, kv, m, "a")
+	b, clockB := newShardedTestCollector(t, kv, m, "b")
+	a.Strategy, b.Strategy = strategy, strategy
+
+	ctxA, cancelA := context.WithCancel(context.Background())
+	defer cancelA()
+	ctxB, cancelB := context.WithCancel(context.Background())
+	errChA := runInBackground(ctxA, a)
+	errChB := runInBackground(ctxB, b)
+
+	both := []string{"a", "b"}
+	waitFor(t, "both members", func() bool {
+		return reflect.DeepEqual(a.shard.list(), both) && reflect.DeepEqual(b.shard.list(), both)
+	})
+	if members := a.Status().Members; !reflect.DeepEqual(members, both) {
+		t.Fatalf("expected members %v in status, got %v", both, members)
+	}
+
+	collectTwice(t, clockA)
+	collectTwice(t, clockB)
+	ownedA, ownedB := collectedServices(a), collectedServices(b)
+	if len(ownedA) == 0 || len(ownedB) == 0 {
+		t.Fatalf("expected both members to collect, got %v and %v", ownedA, ownedB)
+	}
+	for _, service := range ownedA {
+		if stringInSlice(service, ownedB) {
+			t.Fatalf("%s collected by both members", service)
+		}
+	}
+	union := append(append([]string(nil), ownedA...), ownedB...)
+	sort.Strings(union)
+	if !reflect.DeepEqual(union, all) {
+		t.Fatalf("expected every service to be collected once, got %v", union)
+	}
+
+	// a takes over b's services once b leaves.
+	cancelB()
+	if err := waitForRun(t, errChB); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "b to leave", func() bool {
+		return reflect.DeepEqual(a.shard.list(), []string{"a"})
+	})
+	collectedServices(a)
+	collectTwice(t, clockA)
+	if services := collectedServices(a); !reflect.DeepEqual(services, all) {
+		t.Fatalf("expected a to collect every service, got %v", services)
+	}
+
+	cancelA()
+	if err := waitForRun(t, errChA); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Collecting once under the lock registers as a member of the shard group,
+// and collects only that member's share of the services.
+func TestShardedCollectOnce(t *testing.T) {
+	for _, strategy := range []HealthStrategy{PerServiceStrategy, BulkStrategy} {
+		m := &syntheticConsul{services: 40, instances: 1, nodes: 5}
+		kv := newTestShardKV()
+		kv.set("consul2dogstats/test_lock/members/b", "session-b")
+		c, _ := newShardedTestCollector(t, kv, m, "a")
+		c.Strategy = strategy
+		var queried []string
+		var mtx sync.Mutex
+		catalogService := c.catalogServiceFunc
+		c.catalogServiceFunc = func(service, tag string, q *consul.QueryOptions) ([]*consul.CatalogService, *consul.QueryMeta, error) {
+			mtx.Lock()
+			queried = append(queried, service)
+			mtx.Unlock()
+			return catalogService(service, tag, q)
+		}
+
+		if err := c.CollectOnce(context.Background(), true); err != nil {
+			t.Fatal(err)
+		}
+		var want []string
+		for i := 0; i < m.services; i++ {
+			if service := m.serviceName(i); testShardOwner([]string{"a", "b"}, "dc1", service) == "a" {
+				want = append(want, service)
+			}
+		}
+		sort.Strings(want)
+		if services := collectedServices(c); !reflect.DeepEqual(services, want) {
+			t.Fatalf("%s: expected a to collect %v, got %v", strategy, want, services)
+		}
+		if strategy == BulkStrategy {
+			sort.Strings(queried)
+			if !reflect.DeepEqual(queried, want) {
+				t.Fatalf("expected only the instances of a's services to be queried, got %v", queried)
+			}
+		}
+		if members, _, _ := kv.list("consul2dogstats/test_lock/members/", &consul.QueryOptions{}); len(members) != 1 {
+			t.Fatalf("expected a to deregister once done, got %d members", len(members))
+		}
+	}
+}
+
+// Node checks are counted by the member counting nodes alone, even though
+// every member sees them in the health of its services.
+func TestShardedNodeChecksCountedOnce(t *testing.T) {
+	m := &syntheticConsul{services: 40, instances: 1, nodes: 5}
+	nodeOwner := testShardOwner([]string{"a", "b"}, "dc1", "")
+	kv := newTestShardKV()
+	for _, id := range []string{"a", "b"} {
+		other := "a"
+		if id == "a" {
+			other = "b"
+		}
+		kv.set("consul2dogstats/test_lock/members/"+other, "session-"+other)
+		c, _ := newShardedTestCollector(t, kv, m, id)
+		c.CheckMetrics = true
+		if err := c.CollectOnce(context.Background(), true); err != nil {
+			t.Fatal(err)
+		}
+
+		var nodeChecks, serviceChecks int
+		for _, metric := range c.sink.(*testSink).metrics {
+			switch {
+			case metric.Name != "consul.check.count":
+			case stringInSlice("check_id:serfHealth", metric.Tags):
+				nodeChecks++
+			default:
+				serviceChecks++
+			}
+		}
+		if serviceChecks == 0 {
+			t.Fatalf("expected %s to count the checks of its services", id)
+		}
+		if owner := id == nodeOwner; owner != (nodeChecks > 0) {
+			t.Fatalf("%s counted %d node check series, but owns nodes: %v", id, nodeChecks, owner)
+		}
+	}
+}
+
+func TestShardedSelfMetricsTaggedWithMember(t *testing.T) {
+	kv := newTestShardKV()
+	c, clock := newShardedTestCollector(t, kv, &syntheticConsul{services: 2, instances: 1, nodes: 1}, "a")
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := runInBackground(ctx, c)
+	collectTwice(t, clock)
+	cancel()
+	if err := waitForRun(t, errCh); err != nil {
+		t.Fatal(err)
+	}
+
+	sink := c.sink.(*testSink)
+	sink.mtx.Lock()
+	defer sink.mtx.Unlock()
+	for _, metric := range sink.metrics {
+		if metric.Name == "consul2dogstats.tick.failed" {
+			if !stringInSlice("member:a", metric.Tags) {
+				t.Fatalf("expected self metrics to be tagged with the member, got %v", metric.Tags)
+			}
+			return
+		}
+	}
+	t.Fatal("no self metrics posted")
+}
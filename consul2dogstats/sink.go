@@ -0,0 +1,222 @@
+package consul2dogstats
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/zorkian/go-datadog-api"
+)
+
+// Default time allowed for a sink to accept a batch of metrics.
+const defaultSinkTimeout = 10 * time.Second
+
+// Metric is a single reading, independent of any monitoring vendor.  Tags
+// are in Datadog's key:value form; sinks for other backends translate them
+// as needed.
+type Metric struct {
+	Name      string
+	Value     float64
+	Timestamp time.Time
+	Tags      []string
+	Type      MetricType
+}
+
+// MetricType tells sinks that can aggregate readings how to do so.
+type MetricType int
+
+const (
+	// GaugeType readings give the current value of something.
+	GaugeType MetricType = iota
+	// HistogramType readings are samples of a distribution, which DogStatsD
+	// summarizes as percentiles.  Sinks that can't aggregate them post them
+	// as gauges.
+	HistogramType
+)
+
+// newMetric returns a gauge reading of value taken now.
+func newMetric(name string, value float64, tags []string) Metric {
+	return Metric{Name: name, Value: value, Timestamp: time.Now(), Tags: tags}
+}
+
+// newHistogram returns a histogram sample of value taken now.
+func newHistogram(name string, value float64, tags []string) Metric {
+	metric := newMetric(name, value, tags)
+	metric.Type = HistogramType
+	return metric
+}
+
+// Sink delivers metrics to a monitoring backend.
+type Sink interface {
+	// Send delivers a batch of metrics, returning an error if the backend
+	// didn't accept them.
+	Send(metrics []Metric) error
+}
+
+// datadogClient is the part of *datadog.Client used by DatadogSink.
+type datadogClient interface {
+	PostMetrics(series []datadog.Metric) error
+}
+
+// DatadogSink posts metrics to the Datadog HTTP API.
+type DatadogSink struct {
+	client datadogClient
+}
+
+// NewDatadogSink returns a DatadogSink posting through client, usually a
+// *datadog.Client.
+func NewDatadogSink(client datadogClient) *DatadogSink {
+	return &DatadogSink{client: client}
+}
+
+// Send posts metrics to Datadog as gauges.
+func (s *DatadogSink) Send(metrics []Metric) error {
+	return s.client.PostMetrics(datadogSeries(metrics))
+}
+
+// datadogSeries converts metrics into the series posted to the Datadog API.
+func datadogSeries(metrics []Metric) []datadog.Metric {
+	series := make([]datadog.Metric, 0, len(metrics))
+	for _, metric := range metrics {
+		name := metric.Name
+		series = append(series, datadog.Metric{
+			Metric: &name,
+			Points: []datadog.DataPoint{{float64(metric.Timestamp.Unix()), metric.Value}},
+			Tags:   metric.Tags,
+		})
+	}
+	return series
+}
+
+// FanOut delivers each batch of metrics to several sinks at once, such as
+// Datadog and Prometheus while migrating from one to the other.  Each sink
+// is sent to concurrently and subject to its own timeout, so that a slow or
+// failing backend doesn't hold up or lose metrics for the others.
+//
+// Every batch is accompanied by the consul2dogstats.sink.sent and
+// consul2dogstats.sink.failed metrics, tagged with sink:<name>, counting the
+// batches each sink accepted and failed to accept since the previous batch.
+type FanOut struct {
+	sinks []*fanOutSink
+
+	mtx sync.Mutex
+}
+
+type fanOutSink struct {
+	name    string
+	sink    Sink
+	timeout time.Duration
+
+	// busy is set while a send is in flight.  A send that times out is
+	// left to finish in the background, and the sink is skipped until it
+	// does, so that a hung backend doesn't accumulate goroutines.
+	busy         bool
+	sent, failed int
+}
+
+// NewFanOut returns a FanOut without any sinks.
+func NewFanOut() *FanOut {
+	return new(FanOut)
+}
+
+// Add adds a sink, identified by name in logs and self-metrics.  A send
+// taking longer than timeout is counted as failed; zero means no timeout.
+func (f *FanOut) Add(name string, sink Sink, timeout time.Duration) {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.sinks = append(f.sinks, &fanOutSink{name: name, sink: sink, timeout: timeout})
+}
+
+// Send delivers metrics to every sink, waiting for each until it has
+// accepted them, failed or timed out.  Failures of individual sinks are
+// logged; an error is only returned if no sink accepted the metrics.
+func (f *FanOut) Send(metrics []Metric) error {
+	f.mtx.Lock()
+	sinks := f.sinks
+	metrics = append(metrics, f.sinkMetrics()...)
+	f.mtx.Unlock()
+
+	errCh := make(chan error, len(sinks))
+	for _, s := range sinks {
+		go func(s *fanOutSink) {
+			errCh <- f.send(s, metrics)
+		}(s)
+	}
+
+	var errs []string
+	for range sinks {
+		if err := <-errCh; err != nil {
+			log.Warn(err)
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 && len(errs) == len(sinks) {
+		sort.Strings(errs)
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// send delivers metrics to a single sink and records the outcome.
+func (f *FanOut) send(s *fanOutSink, metrics []Metric) (err error) {
+	f.mtx.Lock()
+	if s.busy {
+		s.failed++
+		f.mtx.Unlock()
+		return fmt.Errorf("sink %s: previous send still in progress", s.name)
+	}
+	s.busy = true
+	f.mtx.Unlock()
+
+	done := make(chan error, 1)
+	go func() {
+		err := s.sink.Send(metrics)
+		f.mtx.Lock()
+		s.busy = false
+		f.mtx.Unlock()
+		done <- err
+	}()
+
+	var timeoutCh <-chan time.Time
+	if s.timeout > 0 {
+		timer := time.NewTimer(s.timeout)
+		defer timer.Stop()
+		timeoutCh = timer.C
+	}
+	select {
+	case err = <-done:
+		if err != nil {
+			err = fmt.Errorf("sink %s: %s", s.name, err)
+		}
+	case <-timeoutCh:
+		err = fmt.Errorf("sink %s: timed out after %s", s.name, s.timeout)
+	}
+
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	if err != nil {
+		s.failed++
+	} else {
+		s.sent++
+	}
+	return err
+}
+
+// sinkMetrics returns the number of batches each sink accepted and failed to
+// accept since the last call, and resets the counts.  The caller must hold
+// f.mtx.
+func (f *FanOut) sinkMetrics() []Metric {
+	metrics := make([]Metric, 0, 2*len(f.sinks))
+	for _, s := range f.sinks {
+		tags := []string{"sink:" + s.name}
+		metrics = append(metrics,
+			newMetric("consul2dogstats.sink.sent", float64(s.sent), tags),
+			newMetric("consul2dogstats.sink.failed", float64(s.failed), tags))
+		s.sent, s.failed = 0, 0
+	}
+	return metrics
+}
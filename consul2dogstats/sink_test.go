@@ -0,0 +1,137 @@
+package consul2dogstats
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zorkian/go-datadog-api"
+)
+
+// recordingDatadogClient mocks *datadog.Client.
+type recordingDatadogClient struct {
+	series []datadog.Metric
+}
+
+func (c *recordingDatadogClient) PostMetrics(series []datadog.Metric) error {
+	c.series = append(c.series, series...)
+	return nil
+}
+
+func TestDatadogSink(t *testing.T) {
+	client := new(recordingDatadogClient)
+	timestamp := time.Unix(1500000000, 0)
+	err := NewDatadogSink(client).Send([]Metric{
+		{Name: "consul.service.count", Value: 3, Timestamp: timestamp, Tags: []string{"service:web"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(client.series) != 1 {
+		t.Fatalf("expected 1 series, got %d", len(client.series))
+	}
+	series := client.series[0]
+	if *series.Metric != "consul.service.count" || len(series.Points) != 1 ||
+		series.Points[0][0] != 1500000000 || series.Points[0][1] != 3 ||
+		len(series.Tags) != 1 || series.Tags[0] != "service:web" {
+		t.Fatalf("unexpected series %+v", series)
+	}
+}
+
+type failingSink struct{}
+
+func (failingSink) Send([]Metric) error {
+	return errors.New("503 Service Unavailable")
+}
+
+// blockingSink never returns until released.
+type blockingSink struct {
+	release chan struct{}
+}
+
+func (s blockingSink) Send([]Metric) error {
+	<-s.release
+	return nil
+}
+
+func TestFanOut(t *testing.T) {
+	good := new(testSink)
+	f := NewFanOut()
+	f.Add("good", good, time.Second)
+	f.Add("bad", failingSink{}, time.Second)
+
+	// A sink failing doesn't fail the batch as long as another accepts it.
+	if err := f.Send([]Metric{newTestGauge("consul.service.count", 1, "service:web")}); err != nil {
+		t.Fatal(err)
+	}
+	if good.sumMetric("consul.service.count", "service:web") != 1 {
+		t.Fatal("expected the healthy sink to receive the metrics")
+	}
+
+	// The outcome of each sink is reported with the following batch.
+	if err := f.Send(nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name, sink string
+		want       float64
+	}{
+		{"consul2dogstats.sink.sent", "good", 1},
+		{"consul2dogstats.sink.failed", "good", 0},
+		{"consul2dogstats.sink.sent", "bad", 0},
+		{"consul2dogstats.sink.failed", "bad", 1},
+	} {
+		if got := good.sumMetric(tc.name, "sink:"+tc.sink); got != tc.want {
+			t.Fatalf("expected %s for sink %s to be %v, got %v", tc.name, tc.sink, tc.want, got)
+		}
+	}
+}
+
+func TestFanOutAllFailed(t *testing.T) {
+	f := NewFanOut()
+	f.Add("api", failingSink{}, time.Second)
+	f.Add("dogstatsd", failingSink{}, time.Second)
+
+	err := f.Send([]Metric{newTestGauge("consul.service.count", 1)})
+	if err == nil {
+		t.Fatal("expected an error when every sink fails")
+	}
+	for _, name := range []string{"sink api: 503", "sink dogstatsd: 503"} {
+		if !strings.Contains(err.Error(), name) {
+			t.Fatalf("expected error to include %q, got %q", name, err)
+		}
+	}
+}
+
+func TestFanOutTimeout(t *testing.T) {
+	good := new(testSink)
+	slow := blockingSink{release: make(chan struct{})}
+	f := NewFanOut()
+	f.Add("good", good, time.Second)
+	f.Add("slow", slow, 50*time.Millisecond)
+
+	start := time.Now()
+	if err := f.Send([]Metric{newTestGauge("consul.service.count", 1)}); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("a hung sink held up the batch for %s", elapsed)
+	}
+
+	// While the hung send is outstanding, the sink is skipped.
+	f.Send(nil)
+	close(slow.release)
+	time.Sleep(50 * time.Millisecond)
+	f.Send(nil)
+
+	if failed := good.sumMetric("consul2dogstats.sink.failed", "sink:slow"); failed != 2 {
+		t.Fatalf("expected the slow sink to have failed 2 batches, got %v", failed)
+	}
+	if sent := good.sumMetric("consul2dogstats.sink.sent", "sink:slow"); sent != 0 {
+		t.Fatalf("expected the slow sink to have accepted no batches, got %v", sent)
+	}
+	if sent := good.sumMetric("consul2dogstats.sink.sent", "sink:good"); sent != 2 {
+		t.Fatalf("expected the good sink to have accepted 2 batches, got %v", sent)
+	}
+}
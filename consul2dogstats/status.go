@@ -0,0 +1,135 @@
+package consul2dogstats
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Status describes what the collector is doing, as served by StatusHandler
+// at /status.
+type Status struct {
+	// Election is the leader election in use.
+	Election LeaderElection `json:"election"`
+	// Leader is true if the collector holds at least one lock.
+	Leader bool `json:"leader"`
+	// Members lists the members of the shard group in sharded lock mode.
+	Members []string `json:"members,omitempty"`
+	// Locks maps each lock key the collector has tried to acquire to
+	// whether it's held.
+	Locks map[string]bool `json:"locks"`
+	// LastTick and LastSuccess are the times of the last collection, and of
+	// the last one that succeeded.  They're nil until there's been one.
+	LastTick    *time.Time `json:"last_tick"`
+	LastSuccess *time.Time `json:"last_success"`
+	// LastError is the error of the last collection, if it failed.
+	LastError string `json:"last_error,omitempty"`
+	// Services maps each datacenter collected from to the number of services
+	// seen in it by the last collection to reach it.
+	Services map[string]int `json:"services"`
+}
+
+// Ready returns whether the collector is a leader whose last collection
+// succeeded.
+func (s *Status) Ready() bool {
+	return s.Leader && s.LastTick != nil && s.LastError == ""
+}
+
+// tickStatus records the outcome of collections for Status.  The zero value
+// is ready to use.
+type tickStatus struct {
+	mtx         sync.Mutex
+	lastTick    time.Time
+	lastSuccess time.Time
+	lastErr     error
+	services    map[string]int
+}
+
+// tick records the outcome of a collection.
+func (t *tickStatus) tick(err error) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.lastTick = time.Now()
+	t.lastErr = err
+	if err == nil {
+		t.lastSuccess = t.lastTick
+	}
+}
+
+// sawServices records the number of services seen in a datacenter.
+func (t *tickStatus) sawServices(datacenter string, count int) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if t.services == nil {
+		t.services = make(map[string]int)
+	}
+	t.services[datacenter] = count
+}
+
+// Status returns what the collector is doing.
+func (c *Collector) Status() *Status {
+	s := &Status{
+		Election: c.election,
+		Locks:    c.stats.locks(),
+		Services: make(map[string]int),
+	}
+	for _, held := range s.Locks {
+		s.Leader = s.Leader || held
+	}
+	if c.shard != nil {
+		s.Members = c.shard.list()
+	}
+
+	c.status.mtx.Lock()
+	defer c.status.mtx.Unlock()
+	if !c.status.lastTick.IsZero() {
+		lastTick := c.status.lastTick
+		s.LastTick = &lastTick
+	}
+	if !c.status.lastSuccess.IsZero() {
+		lastSuccess := c.status.lastSuccess
+		s.LastSuccess = &lastSuccess
+	}
+	if c.status.lastErr != nil {
+		s.LastError = c.status.lastErr.Error()
+	}
+	for datacenter, count := range c.status.services {
+		s.Services[datacenter] = count
+	}
+	return s
+}
+
+// StatusHandler returns an http.Handler serving:
+//
+//   - /healthz, which always responds 200 OK while the process is running;
+//   - /ready, which responds 200 OK if the collector is a leader whose last
+//     collection succeeded, and 503 Service Unavailable otherwise;
+//   - /status, which responds with the collector's Status as JSON.
+//
+// This lets a standby waiting for the lock be told apart from a broken
+// leader.
+func (c *Collector) StatusHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok\n"))
+	})
+	mux.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
+		status := c.Status()
+		switch {
+		case status.Ready():
+			w.Write([]byte("ok\n"))
+		case !status.Leader:
+			http.Error(w, "not leader", http.StatusServiceUnavailable)
+		case status.LastTick == nil:
+			http.Error(w, "no collection yet", http.StatusServiceUnavailable)
+		default:
+			http.Error(w, "last collection failed: "+status.LastError, http.StatusServiceUnavailable)
+		}
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(c.Status())
+	})
+	return mux
+}
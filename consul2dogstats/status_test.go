@@ -0,0 +1,99 @@
+package consul2dogstats
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// get returns the response of the status handler of c to a request for path.
+func get(c *Collector, path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	c.StatusHandler().ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+	return w
+}
+
+func TestStatusStandby(t *testing.T) {
+	c, err := newTestCollector(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if w := get(c, "/healthz"); w.Code != 200 {
+		t.Fatalf("expected a standby to be healthy, got %d", w.Code)
+	}
+	if w := get(c, "/ready"); w.Code != 503 || !strings.Contains(w.Body.String(), "not leader") {
+		t.Fatalf("expected a standby not to be ready, got %d %q", w.Code, w.Body)
+	}
+
+	var status Status
+	w := get(c, "/status")
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Leader || status.LastTick != nil || status.LastSuccess != nil || len(status.Services) != 0 {
+		t.Fatalf("unexpected standby status %+v", status)
+	}
+}
+
+func TestStatusLeader(t *testing.T) {
+	c, err := newTestCollector(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := newTestClock()
+	c.clock = clock
+	stop := startCollector(c)
+	defer stop()
+	waitFor(t, "leadership", func() bool { return c.Status().Leader })
+
+	if w := get(c, "/ready"); w.Code != 503 || !strings.Contains(w.Body.String(), "no collection yet") {
+		t.Fatalf("expected a leader not to be ready before collecting, got %d %q", w.Code, w.Body)
+	}
+
+	// The second tick is only taken once the first collection is posted.
+	clock.tick(t, c.collectInterval)
+	clock.tick(t, c.collectInterval)
+	if w := get(c, "/ready"); w.Code != 200 {
+		t.Fatalf("expected a leader to be ready after collecting, got %d %q", w.Code, w.Body)
+	}
+
+	var status Status
+	w := get(c, "/status")
+	if contentType := w.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Fatalf("unexpected content type %q", contentType)
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if !status.Leader || !status.Locks[c.lockKey] || status.Election != ConsulElection {
+		t.Fatalf("expected to be leader, got %+v", status)
+	}
+	if status.LastTick == nil || status.LastSuccess == nil || !status.LastTick.Equal(*status.LastSuccess) || status.LastError != "" {
+		t.Fatalf("expected last tick to have succeeded, got %+v", status)
+	}
+	if len(status.Services) != 1 || status.Services["dc1"] != 2 {
+		t.Fatalf("expected 2 services in dc1, got %v", status.Services)
+	}
+}
+
+func TestStatusFailedTick(t *testing.T) {
+	c, err := newTestCollector(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.stats.acquired(c.lockKey)
+	c.runTicks(1)
+	c.catalogServicesFunc = flakyCatalogServices(-1)
+	c.runTicks(1)
+
+	status := c.Status()
+	if status.Ready() || status.LastSuccess == nil || !status.LastTick.After(*status.LastSuccess) ||
+		!strings.Contains(status.LastError, "No cluster leader") {
+		t.Fatalf("expected last tick to have failed, got %+v", status)
+	}
+	if w := get(c, "/ready"); w.Code != 503 || !strings.Contains(w.Body.String(), "last collection failed: ") {
+		t.Fatalf("expected a failing leader not to be ready, got %d %q", w.Code, w.Body)
+	}
+}
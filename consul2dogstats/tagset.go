@@ -0,0 +1,58 @@
+package consul2dogstats
+
+import (
+	"bytes"
+	"sort"
+	"strconv"
+)
+
+// tagSet is a canonical set of Datadog tags: sorted, without duplicates and
+// without empty tags, so that two instances with the same tags in any order
+// are counted together.
+type tagSet []string
+
+// newTagSet returns the canonical set of the given tags.  The tags are
+// copied, so the caller's slices are left untouched.
+func newTagSet(tags ...[]string) tagSet {
+	var n int
+	for _, list := range tags {
+		n += len(list)
+	}
+	set := make(tagSet, 0, n)
+	for _, list := range tags {
+		for _, tag := range list {
+			if tag != "" {
+				set = append(set, tag)
+			}
+		}
+	}
+	sort.Strings(set)
+
+	// remove duplicates in place
+	unique := set[:0]
+	for _, tag := range set {
+		if len(unique) == 0 || tag != unique[len(unique)-1] {
+			unique = append(unique, tag)
+		}
+	}
+	return unique
+}
+
+// key returns a string identifying the set, for use as a map key.  Each tag
+// is prefixed with its length, so no two different sets have the same key,
+// whatever characters their tags contain.
+func (s tagSet) key() string {
+	var b bytes.Buffer
+	for _, tag := range s {
+		b.WriteString(strconv.Itoa(len(tag)))
+		b.WriteByte(':')
+		b.WriteString(tag)
+	}
+	return b.String()
+}
+
+// with returns the tags of the set followed by the given tags, in a new
+// slice.
+func (s tagSet) with(tags ...string) []string {
+	return append(append(make([]string, 0, len(s)+len(tags)), s...), tags...)
+}
@@ -0,0 +1,126 @@
+package consul2dogstats
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+func TestNewTagSet(t *testing.T) {
+	for _, tc := range []struct {
+		tags [][]string
+		want tagSet
+	}{
+		{nil, tagSet{}},
+		{[][]string{{""}}, tagSet{}},
+		{[][]string{{"b", "a", "c"}}, tagSet{"a", "b", "c"}},
+		{[][]string{{"a", "b", "a", "", "b"}}, tagSet{"a", "b"}},
+		{[][]string{{"shard:1"}, {"env:prod", "shard:1"}}, tagSet{"env:prod", "shard:1"}},
+		{[][]string{{"a|b", "a", "b"}}, tagSet{"a", "a|b", "b"}},
+		{[][]string{{"région:paris", " spaced ", "key:value:with:colons"}},
+			tagSet{" spaced ", "key:value:with:colons", "région:paris"}},
+	} {
+		if got := newTagSet(tc.tags...); !reflect.DeepEqual(got, tc.want) {
+			t.Fatalf("expected tags %q to give %q, got %q", tc.tags, tc.want, got)
+		}
+	}
+}
+
+func TestTagSetDoesNotModifyInput(t *testing.T) {
+	tags := []string{"b", "a", "b"}
+	newTagSet(tags)
+	if !reflect.DeepEqual(tags, []string{"b", "a", "b"}) {
+		t.Fatalf("input tags modified: %q", tags)
+	}
+}
+
+// Different tag sets must never share a key, however their tags are
+// delimited.
+func TestTagSetKey(t *testing.T) {
+	sets := [][]string{
+		{},
+		{"a"},
+		{"a", "b"},
+		{"a|b"},
+		{"ab"},
+		{"a,b"},
+		{"1:a"},
+		{"1:a", "1:b"},
+		{"1:a1:b"},
+		{"3:1:a"},
+		{"a", "b", "c"},
+		{"a", "b|c"},
+		{"a|b", "c"},
+		{"\x00"},
+		{"\x00", "\x00a"},
+	}
+	seen := make(map[string][]string)
+	for _, tags := range sets {
+		key := newTagSet(tags).key()
+		if other, ok := seen[key]; ok {
+			t.Fatalf("tag sets %q and %q share key %q", other, tags, key)
+		}
+		seen[key] = tags
+	}
+
+	if newTagSet([]string{"b", "a"}).key() != newTagSet([]string{"a", "b", "a"}).key() {
+		t.Fatal("expected equal tag sets to share a key")
+	}
+}
+
+// This mock catalog lists three instances of testService1: one without any
+// tags, and two whose tags contain the characters that used to separate them.
+func edgeCaseTagsHealthService(service, tag string, passingOnly bool, q *consul.QueryOptions) ([]*consul.ServiceEntry, *consul.QueryMeta, error) {
+	if service != "testService1" {
+		return nil, nil, fmt.Errorf("Unknown service %s", service)
+	}
+	var serviceEntries []*consul.ServiceEntry
+	for i, tags := range [][]string{
+		nil,
+		{"route:/a|/b", "", "route:/a|/b"},
+		{"route:/a", "/b"},
+	} {
+		node := fmt.Sprintf("testNode%d", i+1)
+		serviceEntry := new(consul.ServiceEntry)
+		serviceEntry.Service = &consul.AgentService{Service: "testService1", Tags: tags}
+		serviceEntry.Checks = []*consul.HealthCheck{{Node: node, ServiceName: "testService1", Status: "passing"}}
+		serviceEntries = append(serviceEntries, serviceEntry)
+	}
+	return serviceEntries, nil, nil
+}
+
+func TestEdgeCaseTagsMetric(t *testing.T) {
+	c, err := newTestCollector(&testCollectorConfig{
+		catalogServicesFunc: multiTagCatalogServices,
+		healthServiceFunc:   edgeCaseTagsHealthService,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.runTicks(1)
+
+	client := c.sink.(*testSink)
+	for _, metric := range client.metrics {
+		seen := make(map[string]bool)
+		for _, tag := range metric.Tags {
+			if tag == "" {
+				t.Fatalf("empty tag in metric: %q", metric.Tags)
+			}
+			if seen[tag] {
+				t.Fatalf("duplicate tag in metric: %q", metric.Tags)
+			}
+			seen[tag] = true
+		}
+	}
+	client.validateMetrics(t,
+		[]string{"route:/a|/b"},
+		&testStatusCounts{passing: 1, warning: 0, critical: 0})
+	client.validateMetrics(t,
+		[]string{"route:/a", "/b"},
+		&testStatusCounts{passing: 1, warning: 0, critical: 0})
+	client.validateMetrics(t,
+		[]string{"service:testService1"},
+		&testStatusCounts{passing: 3, warning: 0, critical: 0})
+}
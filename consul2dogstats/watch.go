@@ -0,0 +1,498 @@
+package consul2dogstats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	consul "github.com/hashicorp/consul/api"
+)
+
+const (
+	// How long Consul may hold a blocking query open before returning
+	// unchanged results.
+	watchWaitTime = time.Minute
+	// The shortest wait time of the blocking queries of health watches taking
+	// turns.
+	minWatchWaitTime = time.Second
+	// How long to wait after a change is noticed before publishing, so that a
+	// burst of related changes (e.g. a node going down) is published at once.
+	defaultWatchCoalesce = time.Second
+)
+
+// errWatchSyncing is returned by serviceWatcher.snapshot until the health of
+// every service in the catalog has been queried at least once.
+var errWatchSyncing = errors.New("waiting for initial health of all services")
+
+// serviceWatcher maintains a cache of the health of every service in the
+// catalog of a datacenter using Consul blocking queries, and signals on its
+// change channel whenever the status or tags of an instance change.
+type serviceWatcher struct {
+	datacenter          string
+	catalogServicesFunc func(q *consul.QueryOptions) (map[string][]string, *consul.QueryMeta, error)
+	healthServiceFunc   func(service, tag string, passingOnly bool, q *consul.QueryOptions) ([]*consul.ServiceEntry, *consul.QueryMeta, error)
+	serviceFilter       *Filter
+	retry               RetryPolicy
+	stats               *selfStats
+	slots               *watchSlots
+
+	mtx           sync.Mutex
+	rand          *rand.Rand
+	catalogLoaded bool
+	health        map[string][]*consul.ServiceEntry
+	digests       map[string]string
+	stopChs       map[string]chan struct{}
+	errs          map[string]error
+	changeCh      chan struct{}
+}
+
+// newServiceWatcher returns a watcher of the given datacenter which signals
+// changes on changeCh, and whose health watches share slots.  The channel
+// should be buffered, since changes which occur while a previous one is
+// still pending are coalesced.
+func newServiceWatcher(c *Collector, datacenter string, changeCh chan struct{}, slots *watchSlots) *serviceWatcher {
+	return &serviceWatcher{
+		datacenter:          datacenter,
+		catalogServicesFunc: c.catalogServicesFunc,
+		healthServiceFunc:   c.healthServiceFunc,
+		serviceFilter:       c.ServiceFilter,
+		retry:               c.Retry,
+		stats:               &c.stats,
+		slots:               slots,
+		rand:                rand.New(rand.NewSource(c.rand.Int63())),
+		health:              make(map[string][]*consul.ServiceEntry),
+		digests:             make(map[string]string),
+		stopChs:             make(map[string]chan struct{}),
+		errs:                make(map[string]error),
+		changeCh:            changeCh,
+	}
+}
+
+// snapshot returns a copy of the cached health of every service.  It returns
+// an error if the most recent query for the catalog failed.  A service whose
+// most recent query failed keeps its last known health, or is left out if
+// it has none; the failure is reported by the consul2dogstats.watch.failing
+// metric instead.
+func (w *serviceWatcher) snapshot() (map[string][]*consul.ServiceEntry, error) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	if err := w.errs[""]; err != nil {
+		return nil, err
+	}
+	if !w.catalogLoaded {
+		return nil, errWatchSyncing
+	}
+	for name := range w.stopChs {
+		if _, loaded := w.health[name]; !loaded && w.errs[name] == nil {
+			return nil, errWatchSyncing
+		}
+	}
+
+	health := make(map[string][]*consul.ServiceEntry, len(w.health))
+	for name, entries := range w.health {
+		health[name] = entries
+	}
+	return health, nil
+}
+
+// datacenterWatchers serves service health from a serviceWatcher per
+// datacenter, all of which signal changes on the same channel.  It is not
+// safe for concurrent use.
+type datacenterWatchers struct {
+	c        *Collector
+	stopCh   chan struct{}
+	changeCh chan struct{}
+	slots    *watchSlots
+	watchers map[string]*serviceWatcher
+}
+
+func newDatacenterWatchers(c *Collector) *datacenterWatchers {
+	return &datacenterWatchers{
+		c:        c,
+		stopCh:   make(chan struct{}),
+		changeCh: make(chan struct{}, 1),
+		slots:    newWatchSlots(c.Concurrency),
+		watchers: make(map[string]*serviceWatcher),
+	}
+}
+
+// watch starts watching each of the given datacenters, if not already.
+func (d *datacenterWatchers) watch(datacenters ...string) {
+	for _, datacenter := range datacenters {
+		if _, ok := d.watchers[datacenter]; ok {
+			continue
+		}
+		w := newServiceWatcher(d.c, datacenter, d.changeCh, d.slots)
+		d.watchers[datacenter] = w
+		go w.run(d.stopCh)
+	}
+}
+
+// snapshot is a healthSource which returns the cached health of every service
+// in a datacenter, starting to watch it if necessary.
+func (d *datacenterWatchers) snapshot(datacenter string, stopCh <-chan struct{}) (map[string][]*consul.ServiceEntry, consul.HealthChecks, error) {
+	d.watch(datacenter)
+	health, err := d.watchers[datacenter].snapshot()
+	return health, nil, err
+}
+
+// changed returns a channel which receives a value whenever the cached health
+// of any datacenter changes.
+func (d *datacenterWatchers) changed() <-chan struct{} {
+	return d.changeCh
+}
+
+// stop stops every watcher.
+func (d *datacenterWatchers) stop() {
+	close(d.stopCh)
+}
+
+// watchSlots limits the number of health watches with a blocking query in
+// flight, across datacenters, so as to stay within Consul's limit on
+// concurrent connections per client (limits.http_max_conns_per_client).
+// When there are more services than slots, the watches take turns, and each
+// query waits for less time, so that every service is still queried about
+// once every watchWaitTime.  While some services have yet to be queried for
+// the first time, queries wait for as little time as possible, so that the
+// initial sync isn't held up.
+type watchSlots struct {
+	// accessed atomically; first for alignment
+	watches int64
+	pending int64
+
+	ch      chan struct{}
+	minWait time.Duration
+}
+
+// newWatchSlots returns n slots, or a single one if n is less than 1.
+func newWatchSlots(n int) *watchSlots {
+	if n < 1 {
+		n = 1
+	}
+	return &watchSlots{ch: make(chan struct{}, n), minWait: minWatchWaitTime}
+}
+
+// acquire waits for a free slot, returning false if stopCh is closed first.
+func (s *watchSlots) acquire(stopCh <-chan struct{}) bool {
+	select {
+	case s.ch <- struct{}{}:
+		return true
+	case <-stopCh:
+		return false
+	}
+}
+
+func (s *watchSlots) release() {
+	<-s.ch
+}
+
+// start records that a service is being watched, and has yet to be queried.
+func (s *watchSlots) start() {
+	atomic.AddInt64(&s.watches, 1)
+	atomic.AddInt64(&s.pending, 1)
+}
+
+// synced records that a service has been queried for the first time, or
+// that its watch stopped before it was.
+func (s *watchSlots) synced() {
+	atomic.AddInt64(&s.pending, -1)
+}
+
+// stop records that a service is no longer being watched.
+func (s *watchSlots) stop() {
+	atomic.AddInt64(&s.watches, -1)
+}
+
+// waitTime returns the wait time of the next blocking query for health.
+func (s *watchSlots) waitTime() time.Duration {
+	if atomic.LoadInt64(&s.pending) > 0 {
+		return s.minWait
+	}
+	watches, slots := atomic.LoadInt64(&s.watches), int64(cap(s.ch))
+	if watches <= slots {
+		return watchWaitTime
+	}
+	if d := time.Duration(int64(watchWaitTime) * slots / watches); d > s.minWait {
+		return d
+	}
+	return s.minWait
+}
+
+// run watches the catalog until stopCh is closed, starting and stopping a
+// watch on the health of each service as it is registered and deregistered.
+func (w *serviceWatcher) run(stopCh <-chan struct{}) {
+	defer w.stopServices()
+	ctx, cancel := stopContext(stopCh)
+	defer cancel()
+
+	var index uint64
+	var failures int
+	for {
+		services, meta, err := w.catalogServicesFunc((&consul.QueryOptions{
+			Datacenter: w.datacenter,
+			WaitIndex:  index,
+			WaitTime:   watchWaitTime,
+		}).WithContext(ctx))
+		if isClosed(stopCh) {
+			return
+		}
+		w.stats.request(catalogServicesEndpoint, err)
+		if err != nil {
+			failures++
+			w.setError("", err)
+			if !sleep(stopCh, w.backoff(failures)) {
+				return
+			}
+			continue
+		}
+		failures = 0
+		w.setError("", nil)
+		w.updateServices(w.serviceFilter.filterCatalog(services))
+
+		var ok bool
+		if index, ok = nextIndex(stopCh, index, meta, w.retry.InitialBackoff); !ok {
+			return
+		}
+	}
+}
+
+// updateServices starts watches on newly registered services, and stops
+// watches on (and forgets the health of) deregistered ones.
+func (w *serviceWatcher) updateServices(services map[string][]string) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	changed := !w.catalogLoaded
+	w.catalogLoaded = true
+	for name := range services {
+		if _, ok := w.stopChs[name]; !ok {
+			stopCh := make(chan struct{})
+			w.stopChs[name] = stopCh
+			w.slots.start()
+			go w.watchService(name, stopCh)
+		}
+	}
+	for name, stopCh := range w.stopChs {
+		if _, ok := services[name]; !ok {
+			close(stopCh)
+			w.slots.stop()
+			delete(w.stopChs, name)
+			delete(w.health, name)
+			delete(w.digests, name)
+			delete(w.errs, name)
+			changed = true
+		}
+	}
+	w.reportFailing()
+	if changed {
+		w.notify()
+	}
+}
+
+// watchService keeps the cached health of a single service up to date until
+// stopCh is closed, which abandons the query in flight, freeing its slot.
+// Each query waits for a free slot; since it's made with the index of the
+// previous one, it returns straight away if the service changed in the
+// meantime.
+func (w *serviceWatcher) watchService(name string, stopCh <-chan struct{}) {
+	pending := true
+	defer func() {
+		if pending {
+			w.slots.synced()
+		}
+	}()
+	ctx, cancel := stopContext(stopCh)
+	defer cancel()
+
+	var index uint64
+	var failures int
+	for {
+		if !w.slots.acquire(stopCh) {
+			return
+		}
+		entries, meta, err := w.healthServiceFunc(name, "", false, (&consul.QueryOptions{
+			Datacenter: w.datacenter,
+			WaitIndex:  index,
+			WaitTime:   w.slots.waitTime(),
+		}).WithContext(ctx))
+		w.slots.release()
+		if isClosed(stopCh) {
+			return
+		}
+		if pending {
+			w.slots.synced()
+			pending = false
+		}
+		w.stats.request(healthServiceEndpoint, err)
+		if err != nil {
+			failures++
+			w.setError(name, err)
+			if !sleep(stopCh, w.backoff(failures)) {
+				return
+			}
+			continue
+		}
+		failures = 0
+		w.setHealth(name, entries, stopCh)
+
+		var ok bool
+		if index, ok = nextIndex(stopCh, index, meta, w.retry.InitialBackoff); !ok {
+			return
+		}
+	}
+}
+
+// setHealth caches the health of a service, signalling a change if the tags
+// or status of any of its instances differ from what was cached before.
+func (w *serviceWatcher) setHealth(name string, entries []*consul.ServiceEntry, stopCh <-chan struct{}) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	// The service may have been deregistered while the query was in flight.
+	if isClosed(stopCh) {
+		return
+	}
+	if w.errs[name] != nil {
+		delete(w.errs, name)
+		w.reportFailing()
+	}
+	digest := healthDigest(entries)
+	previous, loaded := w.digests[name]
+	w.health[name] = entries
+	w.digests[name] = digest
+	if !loaded || digest != previous {
+		w.notify()
+	}
+}
+
+func (w *serviceWatcher) setError(name string, err error) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	defer w.reportFailing()
+	if err == nil {
+		delete(w.errs, name)
+		return
+	}
+	if name == "" {
+		log.Warnf("Watch of service catalog in %s failed: %s", w.datacenter, err)
+	} else {
+		log.Warnf("Watch of service %s in %s failed: %s", name, w.datacenter, err)
+	}
+	w.errs[name] = err
+}
+
+// reportFailing records the number of watches whose most recent query failed.
+// w.mtx must be held.
+func (w *serviceWatcher) reportFailing() {
+	w.stats.setWatchFailing(w.datacenter, len(w.errs))
+}
+
+// notify signals a change without blocking.  w.mtx must be held.
+func (w *serviceWatcher) notify() {
+	select {
+	case w.changeCh <- struct{}{}:
+	default:
+	}
+}
+
+func (w *serviceWatcher) stopServices() {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	for name, stopCh := range w.stopChs {
+		close(stopCh)
+		w.slots.stop()
+		delete(w.stopChs, name)
+	}
+	w.stats.forgetWatch(w.datacenter)
+}
+
+func (w *serviceWatcher) backoff(failures int) time.Duration {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	return w.retry.backoff(failures, w.rand)
+}
+
+// nextIndex returns the WaitIndex to use for the next blocking query after
+// one returned meta.  Consul may reset its index (e.g. after a snapshot
+// restore), in which case we start over from zero.  If Consul did not return
+// an index at all we have no way to block, so we wait for retryInterval
+// before querying again to avoid hammering the agent.  It returns false if
+// stopCh is closed while waiting.
+func nextIndex(stopCh <-chan struct{}, index uint64, meta *consul.QueryMeta, retryInterval time.Duration) (uint64, bool) {
+	if meta == nil || meta.LastIndex == 0 {
+		return 0, sleep(stopCh, retryInterval)
+	}
+	if meta.LastIndex < index {
+		return 0, true
+	}
+	return meta.LastIndex, true
+}
+
+// sleep waits for d to elapse, returning false if stopCh was closed first.
+func sleep(stopCh <-chan struct{}, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-stopCh:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// healthDigest summarizes the parts of a service's health that affect the
+// metrics we publish.  Blocking queries also return when nothing but the
+// output of a check has changed, which we don't want to treat as a change.
+func healthDigest(entries []*consul.ServiceEntry) string {
+	lines := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		var line []string
+		if entry.Node != nil {
+			line = append(line, entry.Node.Node, metaDigest(entry.Node.Meta))
+		}
+		if entry.Service != nil {
+			tags := append([]string(nil), entry.Service.Tags...)
+			sort.Strings(tags)
+			line = append(line, entry.Service.ID, fmt.Sprintf("%q", tags), metaDigest(entry.Service.Meta))
+		}
+		for _, check := range entry.Checks {
+			line = append(line, check.CheckID+"="+check.Status)
+		}
+		lines = append(lines, fmt.Sprintf("%q", line))
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+// stopContext returns a context which is cancelled once stopCh is closed, so
+// that blocking queries are abandoned as soon as their watch is stopped.  The
+// returned function must be called once the context is no longer needed.
+func stopContext(stopCh <-chan struct{}) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-stopCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// isClosed returns true if ch has been closed.
+func isClosed(ch <-chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
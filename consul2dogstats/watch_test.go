@@ -0,0 +1,387 @@
+package consul2dogstats
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+// testWatchConsul mocks the blocking query behaviour of the Consul catalog
+// and health endpoints.  Queries whose WaitIndex is the current index block
+// until the mocked state changes or the query's wait time elapses.
+type testWatchConsul struct {
+	mtx      sync.Mutex
+	index    uint64
+	services map[string][]*consul.ServiceEntry
+	changeCh chan struct{} // closed and replaced on every change
+}
+
+func newTestWatchConsul() *testWatchConsul {
+	m := &testWatchConsul{
+		index:    1,
+		services: make(map[string][]*consul.ServiceEntry),
+		changeCh: make(chan struct{}),
+	}
+	m.register("testService1", "testNode1", "passing")
+	m.register("testService2", "testNode1", "passing")
+	return m
+}
+
+// wait blocks until the index moves past q.WaitIndex, then returns with
+// m.mtx held.  If the query is cancelled first, it returns the error of its
+// context instead, without m.mtx held.
+func (m *testWatchConsul) wait(q *consul.QueryOptions) error {
+	m.mtx.Lock()
+	for q.WaitIndex >= m.index {
+		changeCh := m.changeCh
+		m.mtx.Unlock()
+		select {
+		case <-changeCh:
+		case <-time.After(q.WaitTime):
+			m.mtx.Lock()
+			return nil
+		case <-q.Context().Done():
+			return q.Context().Err()
+		}
+		m.mtx.Lock()
+	}
+	return nil
+}
+
+// changed bumps the index and wakes up blocked queries.  m.mtx must be held.
+func (m *testWatchConsul) changed() {
+	m.index++
+	close(m.changeCh)
+	m.changeCh = make(chan struct{})
+}
+
+func (m *testWatchConsul) register(service, node, status string) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	entry := new(consul.ServiceEntry)
+	entry.Node = &consul.Node{Node: node}
+	entry.Service = &consul.AgentService{ID: service, Service: service, Tags: []string{"test"}}
+	entry.Checks = []*consul.HealthCheck{{Node: node, CheckID: "service:" + service, ServiceName: service, Status: status}}
+	m.services[service] = append(m.services[service], entry)
+	m.changed()
+}
+
+func (m *testWatchConsul) deregister(service string) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	delete(m.services, service)
+	m.changed()
+}
+
+// setCheck replaces the status and output of the first check of the first
+// instance of the given service.
+func (m *testWatchConsul) setCheck(service, status, output string) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	entry := *m.services[service][0]
+	check := *entry.Checks[0]
+	check.Status = status
+	check.Output = output
+	entry.Checks = []*consul.HealthCheck{&check}
+	m.services[service] = []*consul.ServiceEntry{&entry}
+	m.changed()
+}
+
+func (m *testWatchConsul) catalogServices(q *consul.QueryOptions) (map[string][]string, *consul.QueryMeta, error) {
+	if err := m.wait(q); err != nil {
+		return nil, nil, err
+	}
+	defer m.mtx.Unlock()
+	services := make(map[string][]string)
+	for name := range m.services {
+		services[name] = []string{"test"}
+	}
+	return services, &consul.QueryMeta{LastIndex: m.index}, nil
+}
+
+func (m *testWatchConsul) healthService(service, tag string, passingOnly bool, q *consul.QueryOptions) ([]*consul.ServiceEntry, *consul.QueryMeta, error) {
+	if err := m.wait(q); err != nil {
+		return nil, nil, err
+	}
+	defer m.mtx.Unlock()
+	return m.services[service], &consul.QueryMeta{LastIndex: m.index}, nil
+}
+
+// waitFor polls cond until it returns true, failing the test if that takes
+// more than a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// hasMetric returns true if a service count with the given tags and value
+// has been posted.
+func (c *testSink) hasMetric(value float64, tags ...string) bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+METRIC:
+	for _, metric := range c.metrics {
+		if metric.Name != "consul.service.count" {
+			continue
+		}
+		for _, tag := range tags {
+			if !stringInSlice(tag, metric.Tags) {
+				continue METRIC
+			}
+		}
+		if metric.Value == value {
+			return true
+		}
+	}
+	return false
+}
+
+func TestWatchPublishesChanges(t *testing.T) {
+	m := newTestWatchConsul()
+	c, err := newTestCollector(&testCollectorConfig{
+		catalogServicesFunc: m.catalogServices,
+		healthServiceFunc:   m.healthService,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Watch = true
+	c.watchCoalesce = 10 * time.Millisecond
+	c.collectInterval = time.Hour
+
+	stop := startMainLoop(c)
+	defer stop()
+
+	client := c.sink.(*testSink)
+	waitFor(t, "initial counts", func() bool {
+		return client.hasMetric(1, "service:testService1", "status:passing")
+	})
+
+	m.setCheck("testService1", "critical", "connection refused")
+	waitFor(t, "critical count", func() bool {
+		return client.hasMetric(1, "service:testService1", "status:critical")
+	})
+}
+
+func TestWatchTracksCatalog(t *testing.T) {
+	m := newTestWatchConsul()
+	c, err := newTestCollector(&testCollectorConfig{
+		catalogServicesFunc: m.catalogServices,
+		healthServiceFunc:   m.healthService,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := newServiceWatcher(c, "dc1", make(chan struct{}, 1), newWatchSlots(c.Concurrency))
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	if _, err := w.snapshot(); err != errWatchSyncing {
+		t.Fatalf("expected %v before watch started, got %v", errWatchSyncing, err)
+	}
+	go w.run(stopCh)
+
+	serviceCount := func(n int) func() bool {
+		return func() bool {
+			health, err := w.snapshot()
+			return err == nil && len(health) == n
+		}
+	}
+	waitFor(t, "initial sync", serviceCount(2))
+
+	m.register("testService3", "testNode2", "warning")
+	waitFor(t, "new service", serviceCount(3))
+
+	m.deregister("testService1")
+	waitFor(t, "deregistered service", serviceCount(2))
+
+	health, _ := w.snapshot()
+	if _, ok := health["testService1"]; ok {
+		t.Fatal("deregistered service still present")
+	}
+	if status := health["testService3"][0].Checks[0].Status; status != "warning" {
+		t.Fatalf("expected testService3 to be warning, got %s", status)
+	}
+}
+
+func TestWatchIgnoresCheckOutput(t *testing.T) {
+	m := newTestWatchConsul()
+	c, err := newTestCollector(&testCollectorConfig{
+		catalogServicesFunc: m.catalogServices,
+		healthServiceFunc:   m.healthService,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	changeCh := make(chan struct{}, 1)
+	w := newServiceWatcher(c, "dc1", changeCh, newWatchSlots(c.Concurrency))
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go w.run(stopCh)
+
+	waitFor(t, "initial sync", func() bool {
+		_, err := w.snapshot()
+		return err == nil
+	})
+	// drain the notification of the initial sync
+	select {
+	case <-changeCh:
+	case <-time.After(time.Second):
+		t.Fatal("no notification of initial sync")
+	}
+
+	m.setCheck("testService1", "passing", "HTTP GET /health: 200 OK")
+	select {
+	case <-changeCh:
+		t.Fatal("change of check output alone should not be signalled")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	m.setCheck("testService1", "warning", "HTTP GET /health: 429 Too Many Requests")
+	select {
+	case <-changeCh:
+	case <-time.After(time.Second):
+		t.Fatal("change of check status was not signalled")
+	}
+}
+
+func TestWatchLimitsConcurrentQueries(t *testing.T) {
+	m := newTestWatchConsul()
+	for i := 3; i <= 10; i++ {
+		m.register(fmt.Sprintf("testService%d", i), "testNode1", "passing")
+	}
+	var inFlight, maxInFlight int64
+	healthService := func(service, tag string, passingOnly bool, q *consul.QueryOptions) ([]*consul.ServiceEntry, *consul.QueryMeta, error) {
+		n := atomic.AddInt64(&inFlight, 1)
+		defer atomic.AddInt64(&inFlight, -1)
+		for {
+			max := atomic.LoadInt64(&maxInFlight)
+			if n <= max || atomic.CompareAndSwapInt64(&maxInFlight, max, n) {
+				break
+			}
+		}
+		return m.healthService(service, tag, passingOnly, q)
+	}
+	c, err := newTestCollector(&testCollectorConfig{
+		catalogServicesFunc: m.catalogServices,
+		healthServiceFunc:   healthService,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Concurrency = 2
+	slots := newWatchSlots(c.Concurrency)
+	slots.minWait = 10 * time.Millisecond
+	w := newServiceWatcher(c, "dc1", make(chan struct{}, 1), slots)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go w.run(stopCh)
+
+	waitFor(t, "initial sync", func() bool {
+		health, err := w.snapshot()
+		return err == nil && len(health) == 10
+	})
+	if waitTime := slots.waitTime(); waitTime != watchWaitTime/5 {
+		t.Fatalf("expected watches taking turns to wait for %s, got %s", watchWaitTime/5, waitTime)
+	}
+
+	m.setCheck("testService7", "critical", "")
+	waitFor(t, "change while taking turns", func() bool {
+		health, err := w.snapshot()
+		return err == nil && health["testService7"][0].Checks[0].Status == "critical"
+	})
+	if max := atomic.LoadInt64(&maxInFlight); max > 2 {
+		t.Fatalf("expected at most 2 concurrent health queries, got %d", max)
+	}
+}
+
+// Stopping a watcher abandons its blocking queries straight away, rather than
+// leaving them to hold connections open until their wait time elapses.
+func TestWatchStopCancelsQueries(t *testing.T) {
+	m := newTestWatchConsul()
+	var inFlight int64
+	catalogServices := func(q *consul.QueryOptions) (map[string][]string, *consul.QueryMeta, error) {
+		atomic.AddInt64(&inFlight, 1)
+		defer atomic.AddInt64(&inFlight, -1)
+		return m.catalogServices(q)
+	}
+	healthService := func(service, tag string, passingOnly bool, q *consul.QueryOptions) ([]*consul.ServiceEntry, *consul.QueryMeta, error) {
+		atomic.AddInt64(&inFlight, 1)
+		defer atomic.AddInt64(&inFlight, -1)
+		return m.healthService(service, tag, passingOnly, q)
+	}
+	c, err := newTestCollector(&testCollectorConfig{
+		catalogServicesFunc: catalogServices,
+		healthServiceFunc:   healthService,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	slots := newWatchSlots(c.Concurrency)
+	slots.minWait = watchWaitTime
+	w := newServiceWatcher(c, "dc1", make(chan struct{}, 1), slots)
+	stopCh := make(chan struct{})
+	go w.run(stopCh)
+
+	waitFor(t, "initial sync", func() bool {
+		_, err := w.snapshot()
+		return err == nil
+	})
+	waitFor(t, "every watch to block", func() bool {
+		return atomic.LoadInt64(&inFlight) == 3
+	})
+	close(stopCh)
+	waitFor(t, "the queries to be abandoned", func() bool {
+		return atomic.LoadInt64(&inFlight) == 0
+	})
+}
+
+func TestWatchServiceErrorKeepsLastHealth(t *testing.T) {
+	m := newTestWatchConsul()
+	var failing int32
+	healthService := func(service, tag string, passingOnly bool, q *consul.QueryOptions) ([]*consul.ServiceEntry, *consul.QueryMeta, error) {
+		if service == "testService2" && atomic.LoadInt32(&failing) == 1 {
+			return nil, nil, errors.New("Unexpected response code: 500")
+		}
+		return m.healthService(service, tag, passingOnly, q)
+	}
+	c, err := newTestCollector(&testCollectorConfig{
+		catalogServicesFunc: m.catalogServices,
+		healthServiceFunc:   healthService,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := newServiceWatcher(c, "dc1", make(chan struct{}, 1), newWatchSlots(c.Concurrency))
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go w.run(stopCh)
+
+	waitFor(t, "initial sync", func() bool {
+		_, err := w.snapshot()
+		return err == nil
+	})
+	atomic.StoreInt32(&failing, 1)
+	m.setCheck("testService1", "critical", "")
+	waitFor(t, "failing watch to be reported", func() bool {
+		return valuesByNameAndTag(c.stats.metrics(0, 0, nil))["consul2dogstats.watch.failing watch:dc1"] == 1
+	})
+
+	health, err := w.snapshot()
+	if err != nil {
+		t.Fatalf("expected a failing service watch not to fail the datacenter, got %v", err)
+	}
+	if len(health["testService2"]) != 1 {
+		t.Fatalf("expected the last known health of testService2, got %v", health["testService2"])
+	}
+}
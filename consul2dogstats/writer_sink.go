@@ -0,0 +1,84 @@
+package consul2dogstats
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// Output formats of a WriterSink.
+const (
+	JSONFormat  = "json"
+	TableFormat = "table"
+)
+
+// WriterSink writes metrics to an io.Writer instead of delivering them to a
+// backend, so that what would be posted can be inspected without posting it.
+type WriterSink struct {
+	w      io.Writer
+	format string
+}
+
+// NewWriterSink returns a WriterSink writing to w in the given format:
+// JSONFormat writes each batch as a JSON array of series, as they would be
+// posted to the Datadog API, and TableFormat as a table with one metric per
+// line, sorted by name and tags.
+func NewWriterSink(w io.Writer, format string) (*WriterSink, error) {
+	switch format {
+	case JSONFormat, TableFormat:
+	default:
+		return nil, fmt.Errorf("unknown format %q; must be %q or %q", format, JSONFormat, TableFormat)
+	}
+	return &WriterSink{w: w, format: format}, nil
+}
+
+// Send writes metrics.
+func (s *WriterSink) Send(metrics []Metric) error {
+	if s.format == JSONFormat {
+		b, err := json.MarshalIndent(datadogSeries(metrics), "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = s.w.Write(append(b, '\n'))
+		return err
+	}
+
+	rows := make([][]string, 0, len(metrics))
+	for _, metric := range metrics {
+		tags := append([]string(nil), metric.Tags...)
+		sort.Strings(tags)
+		rows = append(rows, []string{
+			metric.Name,
+			strconv.FormatFloat(metric.Value, 'f', -1, 64),
+			strings.Join(tags, ","),
+		})
+	}
+	sort.Sort(tableRows(rows))
+
+	tw := tabwriter.NewWriter(s.w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "METRIC\tVALUE\tTAGS")
+	for _, row := range rows {
+		if row[2] == "" {
+			// avoid padding the value with trailing spaces
+			row = row[:2]
+		}
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	return tw.Flush()
+}
+
+// tableRows sorts rows of a WriterSink table by metric name, then by tags.
+type tableRows [][]string
+
+func (r tableRows) Len() int      { return len(r) }
+func (r tableRows) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r tableRows) Less(i, j int) bool {
+	if r[i][0] != r[j][0] {
+		return r[i][0] < r[j][0]
+	}
+	return r[i][2] < r[j][2]
+}
@@ -0,0 +1,69 @@
+package consul2dogstats
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/zorkian/go-datadog-api"
+)
+
+func testWriterSinkMetrics() []Metric {
+	timestamp := time.Unix(1500000000, 0)
+	return []Metric{
+		{Name: "consul.service.count", Value: 2, Timestamp: timestamp, Tags: []string{"status:passing", "service:web"}},
+		{Name: "consul.service.count", Value: 0.5, Timestamp: timestamp, Tags: []string{"status:critical", "service:api"}},
+		{Name: "consul2dogstats.tick.failed", Value: 0, Timestamp: timestamp},
+	}
+}
+
+func TestWriterSinkTable(t *testing.T) {
+	var b bytes.Buffer
+	s, err := NewWriterSink(&b, TableFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Send(testWriterSinkMetrics()); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `METRIC                       VALUE  TAGS
+consul.service.count         0.5    service:api,status:critical
+consul.service.count         2      service:web,status:passing
+consul2dogstats.tick.failed  0
+`
+	if got := b.String(); got != want {
+		t.Fatalf("expected:\n%s\ngot:\n%s", want, got)
+	}
+}
+
+func TestWriterSinkJSON(t *testing.T) {
+	var b bytes.Buffer
+	s, err := NewWriterSink(&b, JSONFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Send(testWriterSinkMetrics()); err != nil {
+		t.Fatal(err)
+	}
+
+	var series []datadog.Metric
+	if err = json.Unmarshal(b.Bytes(), &series); err != nil {
+		t.Fatalf("invalid JSON %q: %s", b.String(), err)
+	}
+	if len(series) != 3 {
+		t.Fatalf("expected 3 series, got %d", len(series))
+	}
+	first := series[0]
+	if *first.Metric != "consul.service.count" || first.Points[0][0] != 1500000000 || first.Points[0][1] != 2 ||
+		len(first.Tags) != 2 || first.Tags[0] != "status:passing" {
+		t.Fatalf("unexpected series %+v", first)
+	}
+}
+
+func TestWriterSinkUnknownFormat(t *testing.T) {
+	if _, err := NewWriterSink(new(bytes.Buffer), "yaml"); err == nil {
+		t.Fatal("expected unknown format to be rejected")
+	}
+}
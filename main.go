@@ -1,9 +1,14 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
 	"os"
-
-	"time"
+	"os/signal"
+	"syscall"
 
 	log "github.com/Sirupsen/logrus"
 	consul "github.com/hashicorp/consul/api"
@@ -13,31 +18,89 @@ import (
 )
 
 func main() {
-	log.Infof("Starting %s version git-%s", os.Args[0], version.GitRevision)
+	configPath := flag.String("config", os.Getenv("C2D_CONFIG"),
+		"path to a JSON configuration file (env: C2D_CONFIG)")
+	once := flag.Bool("once", false,
+		"collect once, post the metrics and exit, with a non-zero status if either failed")
+	skipLock := flag.Bool("skip-lock", false,
+		"with -once, collect without acquiring the lock")
+	dryRun := flag.Bool("dry-run", false,
+		"print the metrics to stdout instead of posting them; implies -once -skip-lock")
+	format := flag.String("format", consul2dogstats.TableFormat,
+		"output format of -dry-run: table or json")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [-config file] [-once [-skip-lock]] [-dry-run [-format table|json]] [validate]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *dryRun {
+		*once, *skipLock = true, true
+	}
 
-	consulLockKeypath := os.Getenv("C2D_LOCK_PATH")
-	if consulLockKeypath == "" {
-		consulLockKeypath = "consul2dogstats/.lock"
+	switch command := flag.Arg(0); command {
+	case "":
+	case "validate":
+		os.Exit(validate(*configPath))
+	default:
+		log.Fatalf("Unknown command %q", command)
 	}
-	collectIntervalStr := os.Getenv("C2D_COLLECT_INTERVAL")
-	if collectIntervalStr == "" {
-		collectIntervalStr = "10s"
+
+	log.Infof("Starting %s version git-%s", os.Args[0], version.GitRevision)
+
+	loadConfig := consul2dogstats.LoadConfig
+	if *dryRun {
+		loadConfig = consul2dogstats.LoadDryRunConfig
 	}
-	collectInterval, err := time.ParseDuration(collectIntervalStr)
+	cfg, err := loadConfig(*configPath, os.Getenv)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	datadogAPIKey := os.Getenv("DATADOG_API_KEY")
-	if datadogAPIKey == "" {
-		log.Fatal("DATADOG_API_KEY environment variable must be set")
+	// HTTP endpoints, by listen address, so that the Prometheus exporter and
+	// the status endpoints can share a port.
+	muxes := make(map[string]*http.ServeMux)
+	muxFor := func(addr string) *http.ServeMux {
+		if muxes[addr] == nil {
+			muxes[addr] = http.NewServeMux()
+		}
+		return muxes[addr]
 	}
-	datadogClient := datadog.NewClient(datadogAPIKey, "")
-	if ok, err := datadogClient.Validate(); !ok || err != nil {
-		if err == nil {
-			log.Fatal("Invalid Datadog API key")
+
+	var sink consul2dogstats.Sink
+	if *dryRun {
+		if sink, err = consul2dogstats.NewWriterSink(os.Stdout, *format); err != nil {
+			log.Fatal(err)
 		}
-		log.Fatal(err)
+	} else {
+		sinks := consul2dogstats.NewFanOut()
+		for _, name := range cfg.Sinks() {
+			switch name {
+			case consul2dogstats.APISink:
+				datadogClient := datadog.NewClient(cfg.DatadogAPIKey, "")
+				if ok, err := datadogClient.Validate(); !ok || err != nil {
+					if err == nil {
+						log.Fatal("Invalid Datadog API key")
+					}
+					log.Fatal(err)
+				}
+				sinks.Add(name, consul2dogstats.NewDatadogSink(datadogClient), cfg.SinkTimeout)
+			case consul2dogstats.DogStatsdSink:
+				dogStatsdClient, err := consul2dogstats.NewDogStatsdClient(cfg.StatsdAddr)
+				if err != nil {
+					log.Fatal(err)
+				}
+				defer dogStatsdClient.Close()
+				log.Infof("Sending metrics to DogStatsD at %s", cfg.StatsdAddr)
+				sinks.Add(name, dogStatsdClient, cfg.SinkTimeout)
+			case consul2dogstats.PrometheusSink:
+				// Keep series for a few collections, so that they survive the
+				// odd failure but deregistered services soon disappear.
+				exporter := consul2dogstats.NewPrometheusExporter(3 * cfg.CollectInterval)
+				muxFor(cfg.PrometheusAddr).Handle("/metrics", exporter)
+				sinks.Add(name, exporter, cfg.SinkTimeout)
+			}
+		}
+		sink = sinks
 	}
 
 	consulClient, err := consul.NewClient(consul.DefaultConfig())
@@ -45,13 +108,62 @@ func main() {
 		log.Fatal(err)
 	}
 
-	collector, err := consul2dogstats.NewCollector(datadogClient,
-		consulClient, consulLockKeypath, collectInterval)
+	collector, err := consul2dogstats.NewCollector(sink, consulClient, cfg)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	if err = collector.Run(nil, nil); err != nil {
+	// Stop cleanly on a signal, releasing the lock.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT)
+	go func() {
+		log.Infof("Received %s signal, terminating cleanly", <-sigCh)
+		cancel()
+	}()
+
+	if *once {
+		if err = collector.CollectOnce(ctx, !*skipLock); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if cfg.StatusAddr != "" {
+		statusHandler := collector.StatusHandler()
+		for _, path := range []string{"/healthz", "/ready", "/status"} {
+			muxFor(cfg.StatusAddr).Handle(path, statusHandler)
+		}
+	}
+	// Start serving before waiting for the lock, so that a standby can be
+	// seen to be healthy.
+	for addr, mux := range muxes {
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func(mux *http.ServeMux) {
+			log.Fatal(http.Serve(listener, mux))
+		}(mux)
+		log.Infof("Serving HTTP at http://%s", listener.Addr())
+	}
+
+	if err = collector.Run(ctx); err != nil {
 		log.Fatal(err)
 	}
 }
+
+// validate loads the configuration and reports every problem with it,
+// returning the process exit status.
+func validate(configPath string) int {
+	_, err := consul2dogstats.LoadConfig(configPath, os.Getenv)
+	if errs, ok := err.(consul2dogstats.ConfigErrors); ok {
+		for _, e := range errs {
+			fmt.Fprintln(os.Stderr, e)
+		}
+		return 1
+	}
+	fmt.Println("Configuration is valid")
+	return 0
+}
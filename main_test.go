@@ -2,6 +2,8 @@ package main
 
 import (
 	"bytes"
+	"flag"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"strings"
@@ -10,6 +12,9 @@ import (
 
 const (
 	magicEnvVar = "_C2D_TEST"
+	// Space-separated command line arguments of the process run by
+	// ensureProcessExit
+	argsEnvVar = "_C2D_TEST_ARGS"
 )
 
 // Ensure the program exits when no Datadog API key exists.
@@ -32,9 +37,36 @@ func TestInvalidCollectInterval(t *testing.T) {
 		"C2D_COLLECT_INTERVAL=some_bogus_value")
 }
 
+// Ensure the program exits when the configuration file has unknown settings
+func TestInvalidConfigFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "consul2dogstats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`{"sink": "dogstatsd", "colect_interval": "10s"}`)
+	f.Close()
+
+	ensureProcessExit(t, "TestInvalidConfigFile",
+		false, `unknown setting \"colect_interval\"`,
+		"C2D_CONFIG="+f.Name())
+}
+
+// Ensure -dry-run gets as far as querying Consul without a Datadog API key,
+// since it doesn't post to Datadog.
+func TestDryRunWithoutDatadogAPIKey(t *testing.T) {
+	ensureProcessExit(t, "TestDryRunWithoutDatadogAPIKey",
+		false, "connection refused",
+		argsEnvVar+"=-dry-run", "DATADOG_API_KEY=", "CONSUL_HTTP_ADDR=127.0.0.1:1")
+}
+
 func ensureProcessExit(t *testing.T,
 	testFunction string, exitSuccess bool, match string, env ...string) {
 	if os.Getenv(magicEnvVar) == "1" {
+		if args := os.Getenv(argsEnvVar); args != "" {
+			os.Args = append(os.Args[:1], strings.Fields(args)...)
+			flag.CommandLine = flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+		}
 		main()
 		return
 	}